@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/sdk"
+)
+
+const (
+	DEFAULT_ADMIN_SOCKET = "/run/docker/plugins/ovh-admin.sock"
+
+	adminManifest       = `{"Implements": []}`
+	snapshotListPath    = "/Snapshot.List"
+	snapshotCreatePath  = "/Snapshot.Create"
+	snapshotDeletePath  = "/Snapshot.Delete"
+	snapshotRestorePath = "/Snapshot.Restore"
+	volumeResizePath    = "/Volume.Resize"
+	healthPath          = "/Plugin.Health"
+	metricsPath         = "/metrics"
+)
+
+// Request sent to the admin socket, following the style of the Docker plugin API
+type AdminRequest struct {
+	Volume   string `json:",omitempty"`
+	Snapshot string `json:",omitempty"`
+	Name     string `json:",omitempty"`
+	Freeze   bool   `json:",omitempty"`
+	Size     int    `json:",omitempty"`
+}
+
+// Response returned by the admin socket
+type AdminResponse struct {
+	Err       string
+	Snapshots []Snapshot `json:",omitempty"`
+	Snapshot  *Snapshot  `json:",omitempty"`
+	Volume    *Volume    `json:",omitempty"`
+	Health    *Health    `json:",omitempty"`
+}
+
+// State of the running plugin as shown by the health command
+type Health struct {
+	Version    string
+	Backend    string
+	ServerId   string
+	Credential CredentialStatus
+}
+
+type adminHandler func(context.Context, AdminRequest) AdminResponse
+
+// Serves the administrative commands of a running plugin on a unix socket, these need to run
+// inside the plugin to see the mounted volumes, e.g. to freeze them
+func serveAdmin(d OVHPlugin) error {
+	h := sdk.NewHandler(adminManifest)
+	handle := func(path, operation string, fn adminHandler) {
+		h.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			var req AdminRequest
+			if err := sdk.DecodeRequest(w, r, &req); err != nil {
+				return
+			}
+			log.Infof("Admin request %s: %+v", path, req)
+			ctx, cancel := d.Conf.operationContext(operation)
+			defer cancel()
+			res := fn(ctx, req)
+			res.Err = d.Conf.deadlineMessage(ctx, operation, res.Err)
+			sdk.EncodeResponse(w, res, res.Err != "")
+		})
+	}
+
+	handle(snapshotListPath, OPERATION_LIST, func(ctx context.Context, req AdminRequest) AdminResponse {
+		snapshots, err := d.ListVolumeSnapshots(ctx, req.Volume)
+		if err != nil {
+			return AdminResponse{Err: errorMessage(err)}
+		}
+		return AdminResponse{Snapshots: snapshots}
+	})
+	handle(snapshotCreatePath, OPERATION_SNAPSHOT, func(ctx context.Context, req AdminRequest) AdminResponse {
+		snapshot, err := d.CreateVolumeSnapshot(ctx, req.Volume, req.Name, req.Freeze)
+		if err != nil {
+			return AdminResponse{Err: errorMessage(err)}
+		}
+		return AdminResponse{Snapshot: &snapshot}
+	})
+	handle(snapshotDeletePath, OPERATION_SNAPSHOT, func(ctx context.Context, req AdminRequest) AdminResponse {
+		if err := d.DeleteVolumeSnapshot(ctx, req.Snapshot); err != nil {
+			return AdminResponse{Err: errorMessage(err)}
+		}
+		return AdminResponse{}
+	})
+	handle(snapshotRestorePath, OPERATION_CREATE, func(ctx context.Context, req AdminRequest) AdminResponse {
+		vol, err := d.RestoreSnapshot(ctx, req.Snapshot, req.Volume)
+		if err != nil {
+			return AdminResponse{Err: errorMessage(err)}
+		}
+		return AdminResponse{Volume: &vol}
+	})
+	handle(volumeResizePath, OPERATION_RESIZE, func(ctx context.Context, req AdminRequest) AdminResponse {
+		vol, err := d.ResizeVolume(ctx, req.Volume, req.Size)
+		if err != nil {
+			return AdminResponse{Err: errorMessage(err)}
+		}
+		return AdminResponse{Volume: &vol}
+	})
+
+	handle(healthPath, OPERATION_GET, func(ctx context.Context, req AdminRequest) AdminResponse {
+		return AdminResponse{Health: &Health{
+			Version:    VERSION,
+			Backend:    d.Conf.Backend,
+			ServerId:   d.Conf.ServerId,
+			Credential: d.Credentials.Status(),
+		}}
+	})
+
+	h.HandleFunc(metricsPath, d.Metrics.ServeHTTP)
+
+	gid, err := socketGroupId(d.Conf.SocketGroup)
+	if err != nil {
+		return err
+	}
+	log.Infof("Serving admin commands on %s", d.Conf.AdminSocket)
+	return h.ServeUnix(d.Conf.AdminSocket, gid)
+}
+
+// Client for the admin socket of a running plugin, used by the command line interface
+type AdminClient struct {
+	socket string
+	client *http.Client
+}
+
+func NewAdminClient(socket string) *AdminClient {
+	return &AdminClient{
+		socket: socket,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Sends a request to the admin socket, errors reported by the plugin are returned as error
+func (c *AdminClient) Call(path string, req AdminRequest) (AdminResponse, error) {
+	var res AdminResponse
+	body, err := json.Marshal(req)
+	if err != nil {
+		return res, err
+	}
+	httpRes, err := c.client.Post("http://plugin"+path, sdk.DefaultContentTypeV1_1, bytes.NewReader(body))
+	if err != nil {
+		return res, fmt.Errorf("Could not reach the plugin on %s, is it running? %s", c.socket, err)
+	}
+	defer httpRes.Body.Close()
+	if err := json.NewDecoder(httpRes.Body).Decode(&res); err != nil {
+		return res, fmt.Errorf("Invalid response from the plugin (HTTP %d): %s", httpRes.StatusCode, err)
+	}
+	if res.Err != "" {
+		return res, errors.New(res.Err)
+	}
+	return res, nil
+}
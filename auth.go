@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+	"github.com/yosuke-furukawa/json5/encoding/json5"
+)
+
+// Page to create the application key and secret of an OVH API application
+const OVH_CREATE_APP_URL = "https://eu.api.ovh.com/createApp/"
+
+// Details of a consumer key returned by /auth/currentCredential
+type Credential struct {
+	CredentialId  int64            `json:"credentialId"`
+	ApplicationId int64            `json:"applicationId"`
+	Status        string           `json:"status"` // pendingValidation, validated, expired or refused
+	Creation      string           `json:"creation"`
+	Expiration    string           `json:"expiration"`
+	LastUse       string           `json:"lastUse"`
+	Rules         []ovh.AccessRule `json:"rules"`
+}
+
+// Returns the access rules the plugin needs for the project, or * for all projects. A read-only
+// key only allows inspecting volumes, a key without delete rights cannot remove volumes or snapshots.
+func consumerKeyRules(projectId string, readOnly, noDelete bool) []ovh.AccessRule {
+	if projectId == "" {
+		projectId = "*"
+	}
+	methods := ovh.ReadWrite
+	switch {
+	case readOnly:
+		methods = ovh.ReadOnly
+	case noDelete:
+		methods = ovh.ReadWriteSafe
+	}
+	ck := &ovh.CkRequest{}
+	ck.AddRecursiveRules(methods, fmt.Sprintf("/cloud/project/%s/volume", projectId))
+	// used to find the id of this server and to show the names of the servers using a volume
+	ck.AddRule("GET", fmt.Sprintf("/cloud/project/%s/instance", projectId))
+	return ck.AccessRules
+}
+
+// Requests a consumer key with the rights of the plugin, waits for the user to validate it and
+// stores it in the config file
+func runAuthCommand(cfgFile string, args []string) int {
+	flags := flag.NewFlagSet("auth", flag.ExitOnError)
+	readOnly := flags.Bool("read-only", false, "only allow inspecting volumes, e.g. for monitoring")
+	noDelete := flags.Bool("no-delete", false, "do not allow removing volumes and snapshots")
+	wait := flags.Duration("wait", 10*time.Minute, "how long to wait for the consumer key to be validated")
+	write := flags.Bool("write", true, "store the consumer key in the config file")
+	conf := Config{}
+	content, err := ioutil.ReadFile(cfgFile)
+	if err == nil {
+		err = json5.Unmarshal(content, &conf)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Error reading config file %s: %s\n", cfgFile, err)
+		return 1
+	}
+	applyEnvironment(&conf)
+	if conf.OVHEndpoint == "" {
+		conf.OVHEndpoint = "ovh-eu"
+	}
+	if conf.APIRetryTimeout <= 0 {
+		conf.APIRetryTimeout = 60
+	}
+	flags.StringVar(&conf.OVHEndpoint, "endpoint", conf.OVHEndpoint, "OVH API endpoint")
+	flags.StringVar(&conf.ApplicationKey, "application-key", conf.ApplicationKey, "application key, read from the config file by default")
+	flags.StringVar(&conf.ApplicationSecret, "application-secret", conf.ApplicationSecret, "application secret, read from the config file by default")
+	flags.StringVar(&conf.ProjectId, "project", conf.ProjectId, "project the key is limited to, all projects when empty")
+	flags.Parse(args)
+
+	if conf.ApplicationKey == "" || conf.ApplicationSecret == "" {
+		fmt.Fprintf(os.Stderr, "Set ApplicationKey and ApplicationSecret in %s first, create an application at %s to get them\n", cfgFile, OVH_CREATE_APP_URL)
+		return 1
+	}
+	conf.ConsumerKey = ""
+	client, err := NewOVHClient(&conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	rules := consumerKeyRules(conf.ProjectId, *readOnly, *noDelete)
+	ctx, cancel := context.WithTimeout(context.Background(), *wait)
+	defer cancel()
+	state, err := client.RequestConsumerKey(ctx, rules)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", errorMessage(err))
+		return 1
+	}
+	fmt.Printf("Requested a consumer key with these rights:\n\n")
+	for _, rule := range rules {
+		fmt.Printf("  %-6s %s\n", rule.Method, rule.Path)
+	}
+	fmt.Printf("\nLog in with your OVH account to validate it, choosing a suitable validity period:\n\n  %s\n\nWaiting for the validation...\n", state.ValidationURL)
+
+	credential, err := client.WaitForValidation(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", errorMessage(err))
+		return 1
+	}
+	fmt.Printf("Consumer key %s is validated", state.ConsumerKey)
+	if credential.Expiration != "" {
+		fmt.Printf(" until %s", credential.Expiration)
+	}
+	fmt.Println()
+
+	if !*write {
+		fmt.Printf("Set ConsumerKey in the config file to %q\n", state.ConsumerKey)
+		return 0
+	}
+	if _, err := os.Stat(cfgFile); os.IsNotExist(err) {
+		fmt.Printf("Config file %s does not exist, set OVH_CONSUMER_KEY=%s in the environment of the plugin, e.g. using `docker plugin set`\n", cfgFile, state.ConsumerKey)
+		return 0
+	}
+	if err := writeConsumerKey(cfgFile, state.ConsumerKey); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s, set ConsumerKey to %q yourself\n", err, state.ConsumerKey)
+		return 1
+	}
+	fmt.Printf("Stored the consumer key in %s, restart the plugin to use it\n", cfgFile)
+	return 0
+}
+
+// Asks OVH for a new consumer key with the given rights, which the user has to validate before
+// it can be used. The client uses the new key from then on.
+func (oc *OVHClient) RequestConsumerKey(ctx context.Context, rules []ovh.AccessRule) (*ovh.CkValidationState, error) {
+	state := &ovh.CkValidationState{}
+	request := ovh.CkRequest{AccessRules: rules}
+	err := oc.call(ctx, "request a consumer key", false, func() error {
+		return oc.send(ctx, "POST", "/auth/credential", request, state, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// requests in flight keep using the previous key
+	oc.mutex.Lock()
+	api := *oc.api
+	api.ConsumerKey = state.ConsumerKey
+	oc.api = &api
+	oc.mutex.Unlock()
+	return state, nil
+}
+
+// Returns the details of the consumer key of the client
+func (oc *OVHClient) CurrentCredential(ctx context.Context) (credential Credential, err error) {
+	err = oc.call(ctx, "retrieve the consumer key details", true, func() error {
+		return oc.send(ctx, "GET", "/auth/currentCredential", nil, &credential, true)
+	})
+	return
+}
+
+// Polls the consumer key of the client until the user validated it, or refused it
+func (oc *OVHClient) WaitForValidation(ctx context.Context) (Credential, error) {
+	for {
+		credential, err := oc.CurrentCredential(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return credential, errors.New("Gave up waiting for the consumer key to be validated, run the command again to get a new one")
+		case err == nil && credential.Status == "validated":
+			return credential, nil
+		case err == nil && credential.Status != "pendingValidation":
+			return credential, fmt.Errorf("The consumer key was not validated, its status is %s", credential.Status)
+		case err != nil && apiErrorKind(err) != API_ERROR_CREDENTIALS:
+			// OVH rejects a consumer key pending validation as invalid credentials
+			return credential, err
+		}
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+		}
+	}
+}
+
+var consumerKeyPattern = regexp.MustCompile(`"ConsumerKey"\s*:\s*("(?:[^"\\]|\\.)*")`)
+
+// Sets ConsumerKey in the config file, only replacing its value so the comments and layout of the
+// file are kept
+func writeConsumerKey(cfgFile, key string) error {
+	content, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(cfgFile)
+	if err != nil {
+		return err
+	}
+	value, _ := json.Marshal(key)
+
+	var updated []byte
+	if match := consumerKeyPattern.FindSubmatchIndex(content); match != nil {
+		updated = append(updated, content[:match[2]]...)
+		updated = append(updated, value...)
+		updated = append(updated, content[match[3]:]...)
+	} else if start := regexp.MustCompile(`^\s*\{`).FindIndex(content); start != nil {
+		updated = append(updated, content[:start[1]]...)
+		updated = append(updated, fmt.Sprintf("\n  \"ConsumerKey\": %s,", value)...)
+		updated = append(updated, content[start[1]:]...)
+	} else {
+		return fmt.Errorf("Could not find where to add ConsumerKey in %s", cfgFile)
+	}
+
+	var check Config
+	if err := json5.Unmarshal(updated, &check); err != nil || check.ConsumerKey != key {
+		return fmt.Errorf("Could not update ConsumerKey in %s without breaking it", cfgFile)
+	}
+	tmp := filepath.Join(filepath.Dir(cfgFile), "."+filepath.Base(cfgFile)+".tmp")
+	if err := ioutil.WriteFile(tmp, updated, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cfgFile)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Volume option keys of the autogrow policy
+const (
+	OPT_AUTOGROW      = "autogrow"
+	OPT_AUTOGROW_MAX  = "autogrow_max"
+	OPT_AUTOGROW_STEP = "autogrow_step"
+)
+
+const (
+	// Largest volume OVH creates, used as the cap when no autogrow_max is given
+	MAX_VOLUME_SIZE = 4000
+	// Step used when no autogrow_step is given
+	DEFAULT_AUTOGROW_STEP = "20%"
+	// Time to wait before trying to grow a volume again after a failure
+	AUTOGROW_RETRY_DELAY = 15 * time.Minute
+)
+
+// When and how far to grow a volume automatically
+type AutogrowPolicy struct {
+	Threshold float64 // fraction of the filesystem in use that triggers growing it, e.g. 0.85
+	Max       int     // maximum size in GBs
+	Step      string  // GBs to add, e.g. "10", or a percentage of the current size, e.g. "20%"
+}
+
+// Validates an autogrow volume option
+func validateAutogrowOption(key, value string) error {
+	var err error
+	switch key {
+	case OPT_AUTOGROW:
+		_, err = parseThreshold(value)
+	case OPT_AUTOGROW_MAX:
+		var max int
+		if max, err = strconv.Atoi(value); err == nil && (max < 10 || max > MAX_VOLUME_SIZE) {
+			err = fmt.Errorf("%s must be between 10 and %d GB", key, MAX_VOLUME_SIZE)
+		}
+	case OPT_AUTOGROW_STEP:
+		_, err = autogrowStep(value, 10)
+	}
+	return err
+}
+
+// Parses a usage threshold such as "85%" or "85" into a fraction
+func parseThreshold(value string) (float64, error) {
+	percentage, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || percentage <= 0 || percentage >= 100 {
+		return 0, fmt.Errorf("Invalid threshold %q, expected a percentage between 0 and 100", value)
+	}
+	return percentage / 100, nil
+}
+
+// Returns the number of GBs to add to a volume of the given size, at least one
+func autogrowStep(step string, size int) (int, error) {
+	if strings.HasSuffix(step, "%") {
+		percentage, err := strconv.ParseFloat(strings.TrimSuffix(step, "%"), 64)
+		if err != nil || percentage <= 0 {
+			return 0, fmt.Errorf("Invalid step %q", step)
+		}
+		return int(math.Max(1, math.Ceil(float64(size)*percentage/100))), nil
+	}
+	gbs, err := strconv.Atoi(step)
+	if err != nil || gbs <= 0 {
+		return 0, fmt.Errorf("Invalid step %q, expected a number of GB or a percentage", step)
+	}
+	return gbs, nil
+}
+
+// Returns the autogrow policy of a volume, ok is false if autogrow is not enabled for it
+func autogrowPolicy(vol Volume) (policy AutogrowPolicy, ok bool) {
+	meta := decodeDescription(vol.Description)
+	threshold, err := parseThreshold(meta[OPT_AUTOGROW])
+	if err != nil {
+		return policy, false
+	}
+	policy = AutogrowPolicy{Threshold: threshold, Max: MAX_VOLUME_SIZE, Step: DEFAULT_AUTOGROW_STEP}
+	if max, err := strconv.Atoi(meta[OPT_AUTOGROW_MAX]); err == nil {
+		policy.Max = max
+	}
+	if step := meta[OPT_AUTOGROW_STEP]; step != "" {
+		policy.Step = step
+	}
+	return policy, true
+}
+
+// Returns the fraction of a mounted filesystem in use, counted like df does
+func filesystemUsage(path string) (float64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	used := st.Blocks - st.Bfree
+	if used+st.Bavail == 0 {
+		return 0, nil
+	}
+	return float64(used) / float64(used+st.Bavail), nil
+}
+
+// Entry of the audit log, a file with one JSON object per line
+type AuditEntry struct {
+	Time    time.Time
+	Event   string
+	Volume  string
+	Id      string
+	Usage   float64 `json:",omitempty"`
+	OldSize int     `json:",omitempty"`
+	NewSize int     `json:",omitempty"`
+	Error   string  `json:",omitempty"`
+}
+
+func (d OVHPlugin) audit(entry AuditEntry) {
+	entry.Time = time.Now().UTC()
+	line, err := json.Marshal(entry)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(d.Conf.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err == nil {
+			_, err = f.Write(append(line, '\n'))
+			f.Close()
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to write audit log entry %s: %s", line, err)
+	}
+}
+
+type autogrowJob struct {
+	vol    Volume
+	policy AutogrowPolicy
+	retry  time.Time // do not try to grow the volume before this time
+	capped bool      // the volume reached its maximum size, which was logged
+	// the volume was grown but its filesystem was not, which has to be fixed before growing the
+	// volume any further
+	behind bool
+}
+
+// Grows the filesystems mounted on this server when their usage crosses the threshold of their
+// autogrow policy
+type AutogrowWatcher struct {
+	d    OVHPlugin
+	jobs map[string]*autogrowJob
+}
+
+func NewAutogrowWatcher(d OVHPlugin) *AutogrowWatcher {
+	d.Metrics.Describe("ovh_volume_usage_ratio", "gauge", "Fraction of the filesystem in use, by volume with autogrow enabled")
+	d.Metrics.Describe("ovh_autogrow_total", "counter", "Number of times a volume was grown automatically, by volume and result")
+	return &AutogrowWatcher{d: d, jobs: map[string]*autogrowJob{}}
+}
+
+// Runs the watcher, picking up changed policies every few minutes
+func (w *AutogrowWatcher) Run() {
+	w.refresh()
+	refreshTicker := time.NewTicker(5 * time.Minute)
+	checkTicker := time.NewTicker(time.Duration(w.d.Conf.AutogrowInterval) * time.Second)
+	for {
+		select {
+		case <-refreshTicker.C:
+			w.refresh()
+		case now := <-checkTicker.C:
+			w.check(now)
+		}
+	}
+}
+
+// Updates the policies from the volumes currently attached to this server
+func (w *AutogrowWatcher) refresh() {
+	ctx, cancel := w.d.Conf.operationContext(OPERATION_LIST)
+	defer cancel()
+	volumes, err := w.d.Client.ListVolumes(ctx)
+	if err != nil {
+		log.Errorf("Autogrow watcher could not list volumes: %s", err)
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, vol := range volumes {
+		if !contains(vol.AttachedTo, w.d.Conf.ServerId) {
+			continue
+		}
+		policy, ok := autogrowPolicy(vol)
+		if !ok {
+			continue
+		}
+		seen[vol.Name] = true
+		if job, ok := w.jobs[vol.Name]; ok {
+			if job.policy != policy || job.vol.Size != vol.Size {
+				job.capped = false
+			}
+			job.vol, job.policy = vol, policy
+			continue
+		}
+		w.jobs[vol.Name] = &autogrowJob{vol: vol, policy: policy}
+		log.Infof("Watching the usage of %s to grow it with %+v", vol.Name, policy)
+	}
+	for name := range w.jobs {
+		if !seen[name] {
+			log.Infof("No longer watching the usage of %s", name)
+			delete(w.jobs, name)
+		}
+	}
+}
+
+func (w *AutogrowWatcher) check(now time.Time) {
+	for name, job := range w.jobs {
+		if vs, _ := w.d.State.Get(name); !vs.Mounted || now.Before(job.retry) {
+			continue
+		}
+		usage, err := filesystemUsage(w.d.mountPath(name))
+		if err != nil {
+			log.Errorf("Could not determine the usage of %s: %s", name, err)
+			continue
+		}
+		w.d.Metrics.Set("ovh_volume_usage_ratio", usage, "volume", name)
+		if usage < job.policy.Threshold {
+			continue
+		}
+		w.grow(name, job, usage, now)
+	}
+}
+
+func (w *AutogrowWatcher) grow(name string, job *autogrowJob, usage float64, now time.Time) {
+	entry := AuditEntry{Event: "autogrow", Volume: name, Id: job.vol.Id, Usage: usage, OldSize: job.vol.Size}
+	if job.behind {
+		w.growFilesystem(name, job, entry, now)
+		return
+	}
+	if job.vol.Size >= job.policy.Max {
+		if !job.capped {
+			log.Warningf("Volume %s is %.0f%% full but already at its maximum size of %d GB", name, usage*100, job.policy.Max)
+			entry.Event = "autogrow-capped"
+			w.d.audit(entry)
+			job.capped = true
+		}
+		return
+	}
+	step, err := autogrowStep(job.policy.Step, job.vol.Size)
+	if err != nil {
+		log.Errorf("Not growing %s: %s", name, err)
+		return
+	}
+	size := job.vol.Size + step
+	if size > job.policy.Max {
+		size = job.policy.Max
+	}
+	entry.NewSize = size
+
+	log.Infof("Volume %s is %.0f%% full, growing it from %d GB to %d GB", name, usage*100, job.vol.Size, size)
+	ctx, cancel := w.d.Conf.operationContext(OPERATION_RESIZE)
+	defer cancel()
+	vol, err := w.d.ResizeVolume(ctx, name, size)
+	if err != nil {
+		log.Errorf("Failed to grow %s automatically, retrying in %s: %s", name, AUTOGROW_RETRY_DELAY, err)
+		entry.Error = err.Error()
+		job.retry = now.Add(AUTOGROW_RETRY_DELAY)
+		if vol.Size > job.vol.Size {
+			// only the filesystem is retried, growing the volume again would not make it usable
+			job.vol = vol
+			job.behind = true
+		}
+		w.d.Metrics.Add("ovh_autogrow_total", 1, "volume", name, "result", "failure")
+	} else {
+		job.vol = vol
+		w.d.Metrics.Add("ovh_autogrow_total", 1, "volume", name, "result", "success")
+	}
+	w.d.audit(entry)
+}
+
+// Retries growing the filesystem of a volume that was grown before, without growing the volume
+func (w *AutogrowWatcher) growFilesystem(name string, job *autogrowJob, entry AuditEntry, now time.Time) {
+	entry.NewSize = job.vol.Size
+	log.Infof("Growing the filesystem of %s to the %d GB of the volume", name, job.vol.Size)
+	ctx, cancel := w.d.Conf.operationContext(OPERATION_RESIZE)
+	defer cancel()
+	if _, err := w.d.ResizeVolume(ctx, name, job.vol.Size); err != nil {
+		log.Errorf("Failed to grow the filesystem of %s, retrying in %s: %s", name, AUTOGROW_RETRY_DELAY, err)
+		entry.Error = err.Error()
+		job.retry = now.Add(AUTOGROW_RETRY_DELAY)
+		w.d.Metrics.Add("ovh_autogrow_total", 1, "volume", name, "result", "failure")
+	} else {
+		job.behind = false
+		w.d.Metrics.Add("ovh_autogrow_total", 1, "volume", name, "result", "success")
+	}
+	w.d.audit(entry)
+}
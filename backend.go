@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Backends the volumes can be managed with
+const (
+	BACKEND_OVH       = "ovh"       // the OVH API
+	BACKEND_OPENSTACK = "openstack" // the OpenStack APIs of the OVH Public Cloud, Keystone, Cinder and Nova
+	BACKEND_SIMULATOR = "simulator" // the simulated OVH API of the simulate command, with loop devices as disks
+)
+
+// Cloud API managing the volumes, snapshots and instances of a project. The operations changing a
+// volume or snapshot only start the change, CloudClient waits for them to complete. Requests are
+// abandoned when the context is done.
+type VolumeBackend interface {
+	ListVolumes(ctx context.Context) ([]Volume, error)
+	// Returns an empty volume if it does not exist
+	GetVolume(ctx context.Context, volumeId string) (Volume, error)
+	CreateVolume(ctx context.Context, options VolumePost) (Volume, error)
+	UpdateVolume(ctx context.Context, volumeId string, update VolumePut) (Volume, error)
+	DeleteVolume(ctx context.Context, volumeId string) error
+	// Attaches the volume to this server
+	AttachVolume(ctx context.Context, volumeId string) (Volume, error)
+	// Detaches the volume from this server
+	DetachVolume(ctx context.Context, volumeId string) (Volume, error)
+	UpsizeVolume(ctx context.Context, volumeId string, size int) (Volume, error)
+
+	ListSnapshots(ctx context.Context) ([]Snapshot, error)
+	// Returns an empty snapshot if it does not exist
+	GetSnapshot(ctx context.Context, snapshotId string) (Snapshot, error)
+	CreateSnapshot(ctx context.Context, volumeId string, options SnapshotPost) (Snapshot, error)
+	DeleteSnapshot(ctx context.Context, snapshotId string) error
+
+	ListInstances(ctx context.Context) ([]Instance, error)
+}
+
+// Smallest volume the backend creates, in GBs
+func minimumVolumeSize(backend string) int {
+	if backend == BACKEND_OPENSTACK {
+		return 1
+	}
+	return 10
+}
+
+// Creates the backend selected in the config
+func newBackend(conf *Config) (VolumeBackend, error) {
+	switch conf.Backend {
+	case BACKEND_OVH, BACKEND_SIMULATOR:
+		return NewOVHClient(conf)
+	case BACKEND_OPENSTACK:
+		if err := conf.OpenStack.validate(); err != nil {
+			return nil, err
+		}
+		return NewOpenStackClient(conf), nil
+	default:
+		return nil, fmt.Errorf("Unknown backend %s, use %s, %s or %s", conf.Backend, BACKEND_OVH, BACKEND_OPENSTACK, BACKEND_SIMULATOR)
+	}
+}
+
+// Volume backend along with the helpers waiting for its operations to complete, see waiter.go,
+// and a cache of the volume listing that is dropped whenever the plugin changes a volume
+type CloudClient struct {
+	VolumeBackend
+	Conf    *Config
+	volumes *VolumeCache
+}
+
+func NewCloudClient(conf *Config) (*CloudClient, error) {
+	backend, err := newBackend(conf)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Managing volumes using the %s backend", conf.Backend)
+	return &CloudClient{VolumeBackend: backend, Conf: conf, volumes: NewVolumeCache(conf.timeout(conf.VolumeCacheTTL))}, nil
+}
+
+// Lists the volumes of the project, served from the cache for VolumeCacheTTL seconds. The status
+// of cached volumes may be outdated, use GetVolume for the current state of a single volume.
+func (c CloudClient) ListVolumes(ctx context.Context) ([]Volume, error) {
+	volumes, _, err := c.volumes.Get(ctx, c.VolumeBackend.ListVolumes)
+	return volumes, err
+}
+
+// Finds a volume by name using the cached listing, then retrieves its current state by id. The
+// project is listed again when the cached listing turns out to be outdated.
+func (c CloudClient) GetVolumeByName(ctx context.Context, name string) (Volume, error) {
+	for {
+		volumes, cached, err := c.volumes.Get(ctx, c.VolumeBackend.ListVolumes)
+		if err != nil {
+			return Volume{}, err
+		}
+		for _, element := range volumes {
+			if element.Name != name {
+				continue
+			}
+			vol, err := c.GetVolume(ctx, element.Id)
+			if err != nil || (vol.Id != "" && vol.Name == name) || !cached {
+				return vol, err
+			}
+			break
+		}
+		if !cached {
+			return Volume{}, nil
+		}
+		log.Debugf("Volume %s not found in the cached listing, listing the volumes again", name)
+		c.volumes.Invalidate()
+	}
+}
+
+func (c CloudClient) CreateVolume(ctx context.Context, options VolumePost) (Volume, error) {
+	defer c.volumes.Invalidate()
+	return c.VolumeBackend.CreateVolume(ctx, options)
+}
+
+func (c CloudClient) UpdateVolume(ctx context.Context, volumeId string, update VolumePut) (Volume, error) {
+	defer c.volumes.Invalidate()
+	return c.VolumeBackend.UpdateVolume(ctx, volumeId, update)
+}
+
+func (c CloudClient) DeleteVolume(ctx context.Context, volumeId string) error {
+	defer c.volumes.Invalidate()
+	return c.VolumeBackend.DeleteVolume(ctx, volumeId)
+}
+
+// Attaches a volume to this server and waits until it is attached
+func (c CloudClient) AttachVolume(ctx context.Context, volumeId string) (Volume, error) {
+	defer c.volumes.Invalidate()
+	if _, err := c.VolumeBackend.AttachVolume(ctx, volumeId); err != nil {
+		return Volume{}, err
+	}
+	return c.WaitForAttach(ctx, volumeId)
+}
+
+// Detaches a volume from this server and waits until it is available again
+func (c CloudClient) DetachVolume(ctx context.Context, volumeId string) (Volume, error) {
+	defer c.volumes.Invalidate()
+	if _, err := c.VolumeBackend.DetachVolume(ctx, volumeId); err != nil {
+		return Volume{}, err
+	}
+	return c.WaitForDetach(ctx, volumeId)
+}
+
+// Grows a volume to the given size and waits until the new size is reported
+func (c CloudClient) UpsizeVolume(ctx context.Context, volumeId string, size int) (Volume, error) {
+	defer c.volumes.Invalidate()
+	if _, err := c.VolumeBackend.UpsizeVolume(ctx, volumeId, size); err != nil {
+		return Volume{}, err
+	}
+	return c.WaitForUpsize(ctx, volumeId, size)
+}
+
+// Deletes a snapshot and waits until it is gone
+func (c CloudClient) DeleteSnapshot(ctx context.Context, snapshotId string) error {
+	if err := c.VolumeBackend.DeleteSnapshot(ctx, snapshotId); err != nil {
+		return err
+	}
+	return c.WaitForSnapshotDelete(ctx, snapshotId)
+}
+
+// Finds the instance having one of the given ip addresses
+func (c CloudClient) GetInstanceByIps(ctx context.Context, ips []string) (instance Instance, err error) {
+	instances, err := c.ListInstances(ctx)
+	if err != nil {
+		log.Errorf("Could not get instances: %s", err)
+		return instance, err
+	}
+	// loop over all instances, ip addresses and see if there's any overlap
+	for _, i := range instances {
+		log.Debugf("Checking instance %s's ips against %s", i.Name, ips)
+		for _, ipAddress := range i.IpAddresses {
+			if contains(ips, ipAddress.Ip) {
+				return i, nil
+			}
+		}
+	}
+	return
+}
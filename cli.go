@@ -0,0 +1,256 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yosuke-furukawa/json5/encoding/json5"
+)
+
+const usage = `Usage: ovh-docker-volume-plugin [options] <command>
+
+Commands:
+  auth [options]                 create a consumer key with the rights the plugin needs and store it
+                                 in the config file, see auth -h
+  health                         show the state of the running plugin and its OVH consumer key, exits
+                                 with 1 when the key is not valid
+  resize <volume> <size>         grow a volume to the given size in GB, including its filesystem
+  snapshot <command>             manage snapshots, see below
+  simulate [options]             serve a simulated OVH API for local testing, see simulate -h
+
+Snapshot commands:
+  list [volume]                  list the snapshots of a volume, or all snapshots
+  create [-name n] [-freeze] <volume>
+                                 snapshot a volume, optionally freezing its filesystem
+  delete <snapshot>              delete a snapshot by id or name
+  restore <snapshot> <volume>    create a new volume from a snapshot
+`
+
+// Runs a command line subcommand, most of them against the admin socket of the running plugin, and
+// returns the exit code. Without an admin socket the one set in the config file is used.
+func runCommand(cfgFile, adminSocket string, args []string) int {
+	if adminSocket == "" {
+		adminSocket = configuredAdminSocket(cfgFile)
+	}
+	client := NewAdminClient(adminSocket)
+	switch args[0] {
+	case "auth":
+		return runAuthCommand(cfgFile, args[1:])
+	case "health":
+		return runHealthCommand(client)
+	case "resize":
+		return runResizeCommand(client, args[1:])
+	case "snapshot":
+		return runSnapshotCommand(client, args[1:])
+	case "simulate":
+		return runSimulateCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n%s", args[0], usage)
+		return 2
+	}
+}
+
+// Returns AdminSocket of the config file, or the default socket if the file does not set it or
+// cannot be read
+func configuredAdminSocket(cfgFile string) string {
+	var conf Config
+	if content, err := ioutil.ReadFile(cfgFile); err == nil && json5.Unmarshal(content, &conf) == nil && conf.AdminSocket != "" {
+		return conf.AdminSocket
+	}
+	return DEFAULT_ADMIN_SOCKET
+}
+
+func runHealthCommand(client *AdminClient) int {
+	res, err := client.Call(healthPath, AdminRequest{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	if res.Health == nil {
+		fmt.Fprintf(os.Stderr, "Error: the plugin did not report its health\n")
+		return 1
+	}
+	health, credential := res.Health, res.Health.Credential
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Version:\t%s\n", health.Version)
+	fmt.Fprintf(w, "Backend:\t%s\n", health.Backend)
+	fmt.Fprintf(w, "Server:\t%s\n", health.ServerId)
+	switch {
+	case health.Backend == BACKEND_OPENSTACK:
+		fmt.Fprintf(w, "Credential:\tnot checked for the %s backend\n", health.Backend)
+	case !credential.Valid:
+		fmt.Fprintf(w, "Credential:\tinvalid\n")
+	case !credential.Known:
+		fmt.Fprintf(w, "Credential:\tunknown, all operations are allowed\n")
+	default:
+		fmt.Fprintf(w, "Credential:\t%s\n", credential.Status)
+	}
+	if credential.Expiration != "" {
+		fmt.Fprintf(w, "Expires:\t%s\n", credential.Expiration)
+	}
+	if len(credential.Missing) > 0 {
+		fmt.Fprintf(w, "Not allowed to:\t%s\n", strings.Join(credential.Missing, ", "))
+	}
+	if credential.Error != "" {
+		fmt.Fprintf(w, "Error:\t%s\n", credential.Error)
+	}
+	if !credential.Checked.IsZero() {
+		fmt.Fprintf(w, "Checked:\t%s\n", credential.Checked.Format(time.RFC3339))
+	}
+	w.Flush()
+	if !credential.Valid {
+		return 1
+	}
+	return 0
+}
+
+func runResizeCommand(client *AdminClient, args []string) int {
+	if len(args) != 2 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	size, err := strconv.Atoi(args[1])
+	if err != nil || size <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid size %s, expected a number of GB\n", args[1])
+		return 2
+	}
+	res, err := client.Call(volumeResizePath, AdminRequest{Volume: args[0], Size: size})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Volume %s (%s) is now %d GB\n", res.Volume.Name, res.Volume.Id, res.Volume.Size)
+	return 0
+}
+
+func runSnapshotCommand(client *AdminClient, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	var err error
+	switch command, args := args[0], args[1:]; command {
+	case "list", "ls":
+		req := AdminRequest{}
+		if len(args) > 0 {
+			req.Volume = args[0]
+		}
+		var res AdminResponse
+		if res, err = client.Call(snapshotListPath, req); err == nil {
+			printSnapshots(res.Snapshots)
+		}
+	case "create":
+		flags := flag.NewFlagSet("snapshot create", flag.ExitOnError)
+		name := flags.String("name", "", "name of the snapshot, defaults to the volume name and current time")
+		freeze := flags.Bool("freeze", false, "freeze the filesystem while taking the snapshot, the volume must be mounted")
+		flags.Parse(args)
+		if flags.NArg() != 1 {
+			fmt.Fprint(os.Stderr, usage)
+			return 2
+		}
+		var res AdminResponse
+		if res, err = client.Call(snapshotCreatePath, AdminRequest{Volume: flags.Arg(0), Name: *name, Freeze: *freeze}); err == nil {
+			printSnapshots([]Snapshot{*res.Snapshot})
+		}
+	case "delete", "rm":
+		if len(args) != 1 {
+			fmt.Fprint(os.Stderr, usage)
+			return 2
+		}
+		if _, err = client.Call(snapshotDeletePath, AdminRequest{Snapshot: args[0]}); err == nil {
+			fmt.Printf("Deleted snapshot %s\n", args[0])
+		}
+	case "restore":
+		if len(args) != 2 {
+			fmt.Fprint(os.Stderr, usage)
+			return 2
+		}
+		var res AdminResponse
+		if res, err = client.Call(snapshotRestorePath, AdminRequest{Snapshot: args[0], Volume: args[1]}); err == nil {
+			fmt.Printf("Restored snapshot %s into volume %s (%s)\n", args[0], res.Volume.Name, res.Volume.Id)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown snapshot command %s\n\n%s", command, usage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Serves the simulated OVH API until interrupted, the plugin is then pointed at it through its config
+func runSimulateCommand(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:8086", "address to serve the simulated API on")
+	loopDir := flags.String("loop-dir", "", "directory of the image files backing the volumes, attached volumes become loop devices (requires root)")
+	delay := flags.Duration("delay", 2*time.Second, "time volumes spend in transitional states such as creating and attaching")
+	failureRate := flags.Float64("failure-rate", 0, "fraction of requests failing with a 503 error")
+	conf := SimulatorConfig{}
+	flags.StringVar(&conf.ProjectId, "project", "simulated-project", "id of the simulated project")
+	flags.StringVar(&conf.Region, "region", "GRA1", "region of the simulated project")
+	flags.StringVar(&conf.ApplicationKey, "application-key", "simulator-application-key", "application key clients must use")
+	flags.StringVar(&conf.ApplicationSecret, "application-secret", "simulator-application-secret", "application secret clients must sign requests with")
+	flags.StringVar(&conf.ConsumerKey, "consumer-key", "simulator-consumer-key", "consumer key clients must use")
+	flags.Parse(args)
+	conf.Delay = *delay
+	conf.FailureRate = *failureRate
+	conf.LoopDir = *loopDir
+
+	simulator, err := NewSimulator(conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	fmt.Printf(`Serving the simulated OVH API on %[1]s, configure the plugin with:
+
+  "Backend": "simulator",
+  "OVHEndpoint": "http://%[1]s/1.0",
+  "ApplicationKey": %[2]q,
+  "ApplicationSecret": %[3]q,
+  "ConsumerKey": %[4]q,
+  "ProjectId": %[5]q,
+  "ServerId": %[6]q,
+  "DefaultRegion": %[7]q
+`, listener.Addr(), conf.ApplicationKey, conf.ApplicationSecret, conf.ConsumerKey, conf.ProjectId, simulator.InstanceId(), conf.Region)
+	if conf.LoopDir == "" {
+		fmt.Println("\nNo -loop-dir given, attached volumes will not get a device.")
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+	http.Serve(listener, simulator)
+	simulator.Close()
+	return 0
+}
+
+func printSnapshots(snapshots []Snapshot) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tVOLUME\tREGION\tSIZE\tSTATUS\tCREATED")
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%dGB\t%s\t%s\n", s.Id, s.Name, s.VolumeId, s.Region, s.Size, s.Status, s.CreationDate)
+	}
+	w.Flush()
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ovh/go-ovh/ovh"
+)
+
+// OVH API call the plugin makes, the path is relative to the project and {id} stands for the id
+// of a volume or snapshot
+type apiRight struct {
+	Method      string
+	Path        string
+	Description string
+}
+
+var (
+	rightListVolumes    = apiRight{"GET", "/volume", "list volumes"}
+	rightCreateVolume   = apiRight{"POST", "/volume", "create volumes"}
+	rightUpdateVolume   = apiRight{"PUT", "/volume/{id}", "change the options of volumes"}
+	rightDeleteVolume   = apiRight{"DELETE", "/volume/{id}", "remove volumes"}
+	rightAttachVolume   = apiRight{"POST", "/volume/{id}/attach", "attach volumes"}
+	rightDetachVolume   = apiRight{"POST", "/volume/{id}/detach", "detach volumes"}
+	rightUpsizeVolume   = apiRight{"POST", "/volume/{id}/upsize", "grow volumes"}
+	rightCreateSnapshot = apiRight{"POST", "/volume/{id}/snapshot", "snapshot volumes"}
+	rightDeleteSnapshot = apiRight{"DELETE", "/volume/snapshot/{id}", "delete snapshots"}
+	rightListInstances  = apiRight{"GET", "/instance", "list the servers of the project"}
+
+	allRights = []apiRight{rightListVolumes, rightCreateVolume, rightUpdateVolume, rightDeleteVolume, rightAttachVolume,
+		rightDetachVolume, rightUpsizeVolume, rightCreateSnapshot, rightDeleteSnapshot, rightListInstances}
+)
+
+// Returns the full path of the call for the project, with a placeholder id
+func (r apiRight) path(projectId string) string {
+	return "/cloud/project/" + projectId + strings.Replace(r.Path, "{id}", "0", -1)
+}
+
+// Whether an access rule of a consumer key allows the call, a * in the rule matches any part of
+// the path, including slashes
+func ruleAllows(rule ovh.AccessRule, method, path string) bool {
+	if rule.Method != method {
+		return false
+	}
+	pattern := "^" + strings.Replace(regexp.QuoteMeta(rule.Path), `\*`, ".*", -1) + "$"
+	matched, _ := regexp.MatchString(pattern, path)
+	return matched
+}
+
+// Keeps track of the rights and expiry of the OVH consumer key, so operations the key does not
+// allow are refused before they start and an expiring key is noticed in time. The key details are
+// only known for the OVH backend, otherwise every operation is allowed.
+type CredentialMonitor struct {
+	mutex   *sync.Mutex
+	conf    *Config
+	client  *OVHClient
+	metrics *Metrics
+
+	credential *Credential // nil while the details could not be retrieved
+	err        error       // why the details could not be retrieved
+	checked    time.Time
+}
+
+// State of the consumer key as shown by the health command
+type CredentialStatus struct {
+	Backend    string
+	Valid      bool     // false once OVH rejected the key or reported it as expired
+	Known      bool     // whether the details of the key could be retrieved
+	Status     string   `json:",omitempty"` // as reported by OVH, e.g. validated or expired
+	Expiration string   `json:",omitempty"` // empty for a key that never expires
+	Missing    []string `json:",omitempty"` // calls of the plugin the key does not allow
+	Error      string   `json:",omitempty"`
+	Checked    time.Time
+}
+
+func NewCredentialMonitor(conf *Config, client *CloudClient, metrics *Metrics) *CredentialMonitor {
+	metrics.Describe("ovh_credential_valid", "gauge", "Whether the OVH consumer key is valid, 1 or 0")
+	metrics.Describe("ovh_credential_expiry_timestamp_seconds", "gauge", "Time the OVH consumer key expires, absent for keys that never expire")
+	m := &CredentialMonitor{mutex: &sync.Mutex{}, conf: conf, metrics: metrics}
+	m.client, _ = client.VolumeBackend.(*OVHClient)
+	return m
+}
+
+// Retrieves the details of the consumer key and warns about missing rights and its expiry
+func (m *CredentialMonitor) Refresh(ctx context.Context) {
+	if m.client == nil {
+		return
+	}
+	credential, err := m.client.CurrentCredential(ctx)
+
+	m.mutex.Lock()
+	m.checked = time.Now()
+	if err != nil {
+		m.err = err
+		// keep the details retrieved before when OVH is not reachable
+		if apiErrorKind(err) == API_ERROR_CREDENTIALS {
+			m.credential = nil
+		}
+	} else {
+		m.credential, m.err = &credential, nil
+	}
+	m.mutex.Unlock()
+
+	switch {
+	case apiErrorKind(err) == API_ERROR_CREDENTIALS:
+		log.Errorf("The OVH consumer key is not valid, volumes cannot be managed until it is replaced: %s", errorMessage(err))
+		m.metrics.Set("ovh_credential_valid", 0)
+		return
+	case err != nil:
+		log.Warningf("Could not retrieve the rights of the OVH consumer key, assuming it allows everything: %s", errorMessage(err))
+		return
+	}
+
+	if credential.Status != "validated" {
+		log.Errorf("The OVH consumer key is %s, volumes cannot be managed until it is replaced. Create a new one using the auth command and restart the plugin", credential.Status)
+		m.metrics.Set("ovh_credential_valid", 0)
+		return
+	}
+	m.metrics.Set("ovh_credential_valid", 1)
+	if missing := m.missing(credential); len(missing) > 0 {
+		log.Warningf("The OVH consumer key does not allow the plugin to %s, these operations will be refused", strings.Join(missing, ", "))
+	}
+	if credential.Expiration == "" {
+		log.Infof("The OVH consumer key is %s and does not expire", credential.Status)
+		return
+	}
+	expiration, err := time.Parse(time.RFC3339, credential.Expiration)
+	if err != nil {
+		log.Warningf("Could not parse the expiration %q of the OVH consumer key: %s", credential.Expiration, err)
+		return
+	}
+	m.metrics.Set("ovh_credential_expiry_timestamp_seconds", float64(expiration.Unix()))
+	remaining := expiration.Sub(time.Now())
+	if remaining <= 0 {
+		log.Errorf("The OVH consumer key expired on %s. Create a new one using the auth command and restart the plugin", credential.Expiration)
+	} else if remaining < time.Duration(m.conf.CredentialExpiryWarning)*24*time.Hour {
+		log.Warningf("The OVH consumer key expires on %s, in %d hours. Create a new one using the auth command and restart the plugin before then",
+			credential.Expiration, int(remaining.Hours()))
+	} else {
+		log.Infof("The OVH consumer key is %s until %s", credential.Status, credential.Expiration)
+	}
+}
+
+// Refreshes the details of the consumer key every few hours to warn about its expiry, or every few
+// minutes while they could not be retrieved
+func (m *CredentialMonitor) Run() {
+	if m.client == nil {
+		return
+	}
+	for {
+		m.mutex.Lock()
+		failed := m.err != nil
+		m.mutex.Unlock()
+		interval := 6 * time.Hour
+		if failed {
+			interval = 5 * time.Minute
+		}
+		time.Sleep(interval)
+
+		ctx, cancel := m.conf.operationContext(OPERATION_GET)
+		m.Refresh(ctx)
+		cancel()
+	}
+}
+
+// Returns the descriptions of the calls the consumer key does not allow
+func (m *CredentialMonitor) missing(credential Credential) []string {
+	var missing []string
+	for _, right := range allRights {
+		if !credentialAllows(credential, right, m.conf.ProjectId) {
+			missing = append(missing, right.Description)
+		}
+	}
+	return missing
+}
+
+func credentialAllows(credential Credential, right apiRight, projectId string) bool {
+	for _, rule := range credential.Rules {
+		if ruleAllows(rule, right.Method, right.path(projectId)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an error describing why the call cannot be made, or nil if the consumer key allows it or
+// its rights are unknown
+func (m *CredentialMonitor) Allows(right apiRight) error {
+	if m.client == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.valid() {
+		return fmt.Errorf("The OVH consumer key is not valid, so the plugin cannot %s. Create a new consumer key using the auth command and restart the plugin", right.Description)
+	}
+	if m.credential == nil || credentialAllows(*m.credential, right, m.conf.ProjectId) {
+		return nil
+	}
+	return fmt.Errorf("The OVH consumer key does not allow the plugin to %s (%s %s). Create a consumer key with this right using the auth command",
+		right.Description, right.Method, right.path(m.conf.ProjectId))
+}
+
+// Whether the consumer key may still be used, as far as is known. Must be called with the mutex held.
+func (m *CredentialMonitor) valid() bool {
+	if apiErrorKind(m.err) == API_ERROR_CREDENTIALS {
+		return false
+	}
+	return m.credential == nil || m.credential.Status == "validated"
+}
+
+func (m *CredentialMonitor) Status() CredentialStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	status := CredentialStatus{Backend: m.conf.Backend, Valid: m.valid(), Checked: m.checked}
+	if m.err != nil {
+		status.Error = errorMessage(m.err)
+	}
+	if m.credential != nil {
+		status.Known = true
+		status.Status = m.credential.Status
+		status.Expiration = m.credential.Expiration
+		status.Missing = m.missing(*m.credential)
+	}
+	return status
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Volume option keys of encrypted volumes
+const (
+	OPT_ENCRYPTED = "encrypted"
+	// Name of the key of an encrypted volume, the volume name by default. Volumes created from a
+	// snapshot of an encrypted volume need the key of the original volume.
+	OPT_KEY_ID = "key_id"
+)
+
+// Whether the volume is encrypted with LUKS
+func isEncrypted(vol Volume) bool {
+	encrypted, _ := strconv.ParseBool(decodeDescription(vol.Description)[OPT_ENCRYPTED])
+	return encrypted
+}
+
+// Returns the name of the key of an encrypted volume
+func keyId(vol Volume) string {
+	if id := decodeDescription(vol.Description)[OPT_KEY_ID]; id != "" {
+		return id
+	}
+	return vol.Name
+}
+
+// Name of the device mapper mapping of an encrypted volume, below /dev/mapper
+func cryptMapping(vol Volume) string {
+	return "ovh-" + vol.Id
+}
+
+// Returns the key with the given name. A key file of that name in KeyDir is used when present,
+// otherwise the key is derived from MasterKey. Without a MasterKey a new random key file is
+// created if create is set, which should only happen when setting up encryption on a volume.
+func (c *Config) encryptionKey(id string, create bool) ([]byte, error) {
+	if c.KeyDir != "" {
+		if strings.ContainsAny(id, "/\x00") || id == "." || id == ".." {
+			return nil, fmt.Errorf("Invalid key id %q", id)
+		}
+		path := filepath.Join(c.KeyDir, id+".key")
+		key, err := ioutil.ReadFile(path)
+		if err == nil {
+			return key, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Failed to read key file %s: %s", path, err)
+		}
+		if c.MasterKey == "" {
+			if !create {
+				return nil, fmt.Errorf("Key file %s does not exist", path)
+			}
+			return createKeyFile(path)
+		}
+	}
+	if c.MasterKey == "" {
+		return nil, fmt.Errorf("No key for %s, set KeyDir or MasterKey in the config to use encrypted volumes", id)
+	}
+	mac := hmac.New(sha256.New, []byte(c.MasterKey))
+	mac.Write([]byte("ovh-docker-volume-plugin/" + id))
+	return mac.Sum(nil), nil
+}
+
+// Writes a new random key to the given path, refusing to overwrite an existing key
+func createKeyFile(path string) ([]byte, error) {
+	key := make([]byte, 64)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	log.Infof("Creating new key file %s, back it up to keep access to the volume", path)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create key file %s: %s", path, err)
+	}
+	if _, err = f.Write(key); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("Failed to write key file %s: %s", path, err)
+	}
+	return key, nil
+}
+
+// Opens the LUKS mapping of an encrypted volume and returns the mapped device. Encryption is only
+// set up on a blank device of a volume the plugin just created, any other device has to hold a
+// LUKS volume already.
+func (d OVHPlugin) openEncrypted(ctx context.Context, name string, vol Volume, device string) (string, error) {
+	mapping := cryptMapping(vol)
+	mapped := filepath.Join("/dev/mapper", mapping)
+	if _, err := os.Stat(mapped); err == nil {
+		log.Infof("Encrypted volume %s is already opened as %s", name, mapped)
+		return mapped, d.State.Update(name, func(vs *VolumeState) { vs.Mapping = mapping })
+	}
+
+	vs, _ := d.State.Get(name)
+	probe, err := probeDevice(ctx, device)
+	switch {
+	case err == nil && probe.FSType == "crypto_LUKS":
+	case err != nil && !vs.Fresh:
+		return "", fmt.Errorf("Could not determine whether device %s of volume %s holds data, refusing to encrypt it: %s", device, name, err)
+	case err == nil && !probe.Blank:
+		return "", fmt.Errorf("Device %s of encrypted volume %s contains %s instead of a LUKS volume, refusing to encrypt or mount it", device, name, probe.Describe())
+	default:
+		key, err := d.Conf.encryptionKey(keyId(vol), true)
+		if err != nil {
+			return "", err
+		}
+		log.Infof("Setting up LUKS encryption on device %s of volume %s", device, name)
+		if err := LuksFormat(ctx, device, key); err != nil {
+			return "", fmt.Errorf("Failed to encrypt device %s: %s", device, err)
+		}
+	}
+
+	key, err := d.Conf.encryptionKey(keyId(vol), false)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Opening encrypted volume %s as %s", name, mapped)
+	if err := LuksOpen(ctx, device, mapping, key); err != nil {
+		return "", fmt.Errorf("Failed to open encrypted device %s, is the key %s correct? %s", device, keyId(vol), err)
+	}
+	return mapped, d.State.Update(name, func(vs *VolumeState) { vs.Mapping = mapping })
+}
+
+// Closes the LUKS mapping of a volume, if it has one
+func (d OVHPlugin) closeEncrypted(name string) error {
+	vs, _ := d.State.Get(name)
+	if vs.Mapping == "" {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join("/dev/mapper", vs.Mapping)); err == nil {
+		log.Infof("Closing encrypted volume %s", name)
+		if err := LuksClose(vs.Mapping); err != nil {
+			return fmt.Errorf("Failed to close encrypted volume %s: %s", name, err)
+		}
+	}
+	return d.State.Update(name, func(vs *VolumeState) { vs.Mapping = "" })
+}
+
+// Returns the device backing a device mapper mapping
+func mappingBackingDevice(mapping string) (string, error) {
+	mapped, err := filepath.EvalSymlinks(filepath.Join("/dev/mapper", mapping))
+	if err != nil {
+		return "", err
+	}
+	slaves, err := filepath.Glob(filepath.Join("/sys/class/block", filepath.Base(mapped), "slaves", "*"))
+	if err != nil || len(slaves) != 1 {
+		return "", fmt.Errorf("Could not determine the device backing %s", mapping)
+	}
+	return "/dev/" + filepath.Base(slaves[0]), nil
+}
+
+func LuksFormat(ctx context.Context, device string, key []byte) error {
+	return cryptsetup(ctx, key, "luksFormat", "--type", "luks2", "--batch-mode", "--key-file", "-", device)
+}
+
+func LuksOpen(ctx context.Context, device, mapping string, key []byte) error {
+	return cryptsetup(ctx, key, "open", "--type", "luks", "--key-file", "-", device, mapping)
+}
+
+// Closes a mapping, without a deadline so a mapping is not left behind half closed
+func LuksClose(mapping string) error {
+	return cryptsetup(context.Background(), nil, "close", mapping)
+}
+
+// Grows an open mapping to the size of its device
+func LuksResize(ctx context.Context, mapping string, key []byte) error {
+	return cryptsetup(ctx, key, "resize", "--key-file", "-", mapping)
+}
+
+// Runs cryptsetup, passing the key on stdin so it never shows up in the process list
+func cryptsetup(ctx context.Context, key []byte, args ...string) error {
+	log.Debug("Perform cryptsetup ", args)
+	cmd := exec.CommandContext(ctx, "cryptsetup", args...)
+	cmd.Stdin = bytes.NewReader(key)
+	out, err := cmd.CombinedOutput()
+	log.Debug("Result of cryptsetup cmd: ", string(out))
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Finds the block device of an attached OVH volume. It is created before attaching the volume to
+// remember the devices already present, so a newly appeared device can be recognised.
+type DeviceResolver struct {
+	known map[string]bool
+	loops bool // whether volumes are loop devices set up by the simulator
+}
+
+func NewDeviceResolver(loops bool) *DeviceResolver {
+	r := &DeviceResolver{known: map[string]bool{}, loops: loops}
+	names, err := listBlockDevices()
+	if err != nil {
+		log.Warningf("Could not list block devices: %s", err)
+	}
+	for _, name := range names {
+		r.known[name] = true
+	}
+	return r
+}
+
+// Waits for the device of the volume to appear, checking again whenever the kernel reports a
+// block device change and at an increasing interval in case those events are missed
+func (r *DeviceResolver) Resolve(ctx context.Context, vol Volume, timeout time.Duration) (string, error) {
+	events, stop, err := watchBlockDevices()
+	if err != nil {
+		log.Debugf("Not watching block device events, polling only: %s", err)
+	} else {
+		defer stop()
+	}
+
+	deadline := time.Now().Add(timeout)
+	b := newBackoff(100*time.Millisecond, 2*time.Second)
+	for {
+		device, problem := r.find(vol)
+		if device != "" {
+			return device, nil
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			if problem == "" {
+				problem = "no matching device appeared"
+			}
+			return "", fmt.Errorf("Could not find the device of volume %s after %s: %s", vol.Id, timeout, problem)
+		}
+		delay := b.next()
+		if delay > remaining {
+			delay = remaining
+		}
+		select {
+		case <-events:
+			log.Debugf("Block devices changed, looking for volume %s", vol.Id)
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", fmt.Errorf("Gave up looking for the device of volume %s: %s", vol.Id, ctx.Err())
+		}
+	}
+}
+
+// Looks for the device of the volume by its serial, its udev by-id link and finally among the
+// devices that appeared since the resolver was created. With the simulator backend, loop devices
+// are recognised by the volume id in the name of their backing file instead. Candidates must be at
+// least as large as the volume, except when matched by serial: OVH may report a stale size right
+// after an upsize.
+// Returns the device path, or a description of why no candidate was accepted.
+func (r *DeviceResolver) find(vol Volume) (string, string) {
+	names, err := listBlockDevices()
+	if err != nil {
+		return "", err.Error()
+	}
+
+	var problems []string
+	accept := func(name, how string) bool {
+		device := "/dev/" + name
+		size, err := DeviceSize(device)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("could not read the size of %s: %s", device, err))
+			return false
+		}
+		if size != int64(vol.Size)*GB {
+			if size < int64(vol.Size)*GB && how != "serial" {
+				problems = append(problems, fmt.Sprintf("%s matches by %s but is %d bytes instead of %d GB", device, how, size, vol.Size))
+				return false
+			}
+			log.Warningf("Device %s of volume %s is %d bytes instead of %d GB", device, vol.Id, size, vol.Size)
+		}
+		log.Debugf("Found device %s of volume %s by %s", device, vol.Id, how)
+		return true
+	}
+
+	if r.loops {
+		loops, _ := listLoopDevices()
+		for name, file := range loops {
+			if strings.Contains(filepath.Base(file), vol.Id) && accept(name, "loop backing file") {
+				return "/dev/" + name, ""
+			}
+		}
+		return "", strings.Join(append(problems, "no loop device is backed by the volume"), ", ")
+	}
+
+	for _, name := range names {
+		if serialMatches(blockDeviceSerial(name), vol.Id) && accept(name, "serial") {
+			return "/dev/" + name, ""
+		}
+	}
+
+	links, _ := filepath.Glob(devicePathForVolume(vol.Id))
+	linked := map[string]bool{}
+	for _, link := range links {
+		if target, err := filepath.EvalSymlinks(link); err == nil {
+			linked[filepath.Base(target)] = true
+		}
+	}
+	if len(linked) > 1 {
+		problems = append(problems, fmt.Sprintf("%d different devices are linked as %s", len(linked), devicePathForVolume(vol.Id)))
+	} else {
+		for name := range linked {
+			if accept(name, "by-id link") {
+				return "/dev/" + name, ""
+			}
+		}
+	}
+
+	var appeared []string
+	for _, name := range names {
+		if !r.known[name] {
+			appeared = append(appeared, name)
+		}
+	}
+	if len(appeared) == 1 && accept(appeared[0], "appearing after the attachment") {
+		return "/dev/" + appeared[0], ""
+	} else if len(appeared) > 1 {
+		problems = append(problems, fmt.Sprintf("devices %s appeared at the same time", strings.Join(appeared, ", ")))
+	}
+	return "", strings.Join(problems, ", ")
+}
+
+// Checks whether a device serial refers to the volume. Virtio devices carry the first 20
+// characters of the volume id, SCSI devices may embed the id in a longer serial.
+func serialMatches(serial, volumeId string) bool {
+	if len(serial) < 8 || volumeId == "" {
+		return false
+	}
+	prefix := volumeId
+	if len(prefix) > 20 {
+		prefix = prefix[0:20]
+	}
+	return strings.HasPrefix(volumeId, serial) || strings.Contains(serial, prefix)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Prefixes of block devices that never back an OVH volume
+var ignoredBlockDevices = []string{"loop", "ram", "zram", "dm-", "md", "sr", "fd", "nbd"}
+
+// Lists the whole-disk block devices known to the kernel, partitions are not included
+func listBlockDevices() ([]string, error) {
+	entries, err := ioutil.ReadDir("/sys/block")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		ignored := false
+		for _, prefix := range ignoredBlockDevices {
+			ignored = ignored || strings.HasPrefix(entry.Name(), prefix)
+		}
+		if !ignored {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// Returns the serial of a block device as reported by virtio or SCSI, empty if it has none
+func blockDeviceSerial(name string) string {
+	dir := filepath.Join("/sys/block", name)
+	for _, attribute := range []string{"serial", "device/serial", "device/wwid"} {
+		if data, err := ioutil.ReadFile(filepath.Join(dir, attribute)); err == nil {
+			if serial := strings.TrimSpace(string(data)); serial != "" {
+				return serial
+			}
+		}
+	}
+	// the unit serial number VPD page of SCSI devices, after its 4 byte header
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "device/vpd_pg80")); err == nil && len(data) > 4 {
+		return strings.TrimSpace(string(bytes.Trim(data[4:], "\x00")))
+	}
+	return ""
+}
+
+// Returns the backing files of the loop devices in use by device name, such as those of the
+// volumes of the simulator
+func listLoopDevices() (map[string]string, error) {
+	entries, err := ioutil.ReadDir("/sys/block")
+	if err != nil {
+		return nil, err
+	}
+	loops := map[string]string{}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "loop") {
+			continue
+		}
+		// only present while the loop device is set up
+		if data, err := ioutil.ReadFile(filepath.Join("/sys/block", entry.Name(), "loop/backing_file")); err == nil {
+			loops[entry.Name()] = strings.TrimSpace(string(data))
+		}
+	}
+	return loops, nil
+}
+
+// Listens for block device uevents of the kernel on a netlink socket. The returned channel
+// receives a value when devices were added, removed or changed, stop closes the socket.
+func watchBlockDevices() (<-chan struct{}, func(), error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, nil, err
+	}
+	// group 1 receives the events of the kernel, without waiting for udev
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1}); err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+	// wake up regularly to notice the watch was stopped
+	timeout := syscall.NsecToTimeval(int64(500 * time.Millisecond))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+
+	events := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, 8192)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			n, err := syscall.Read(fd, buf)
+			if err != nil || n <= 0 {
+				continue
+			}
+			if !bytes.Contains(buf[:n], []byte("\x00SUBSYSTEM=block\x00")) {
+				continue
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, func() { close(done) }, nil
+}
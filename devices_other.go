@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+var errBlockDevicesUnsupported = errors.New("Block devices can only be discovered on Linux")
+
+func listBlockDevices() ([]string, error) {
+	return nil, errBlockDevicesUnsupported
+}
+
+func blockDeviceSerial(name string) string {
+	return ""
+}
+
+func listLoopDevices() (map[string]string, error) {
+	return nil, errBlockDevicesUnsupported
+}
+
+func watchBlockDevices() (<-chan struct{}, func(), error) {
+	return nil, nil, errBlockDevicesUnsupported
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
@@ -8,55 +9,159 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
-	"github.com/ovh/go-ovh/ovh"
 	"github.com/yosuke-furukawa/json5/encoding/json5"
 )
 
 const (
 	VOLUME_TYPE_CLASSIC    = "classic"
 	VOLUME_TYPE_HIGH_SPEED = "high-speed"
+
+	// Mount point inside the plugin rootfs when running as a managed (v2) plugin, must match
+	// the propagatedMount of plugin/config.json
+	MANAGED_MOUNT_POINT = "/mnt/volumes"
+)
+
+// Operations of the driver, the admin socket and the background tasks, each with a deadline set
+// in OperationTimeouts
+const (
+	OPERATION_CREATE    = "Create"
+	OPERATION_REMOVE    = "Remove"
+	OPERATION_MOUNT     = "Mount"
+	OPERATION_UNMOUNT   = "Unmount"
+	OPERATION_GET       = "Get"
+	OPERATION_LIST      = "List"
+	OPERATION_RESIZE    = "Resize"
+	OPERATION_SNAPSHOT  = "Snapshot"
+	OPERATION_RECONCILE = "Reconcile"
 )
 
+// Seconds each operation may take by default
+var defaultOperationTimeouts = map[string]int{
+	OPERATION_CREATE:    900,
+	OPERATION_REMOVE:    300,
+	OPERATION_MOUNT:     300,
+	OPERATION_UNMOUNT:   300,
+	OPERATION_GET:       60,
+	OPERATION_LIST:      60,
+	OPERATION_RESIZE:    900,
+	OPERATION_SNAPSHOT:  1200,
+	OPERATION_RECONCILE: 600,
+}
+
 type Config struct {
 	SocketGroup    string //User group to use for the plugin socket
 	DefaultVolSz   int
 	DefaultVolType string
 	DefaultRegion  string
 
+	// Filesystem settings for new volumes by volume type
+	VolumeTypeDefaults map[string]FilesystemOptions
+
 	MountPoint string
+	StateDir   string // Directory used to persist the local volume state
 	ProjectId  string
 	ServerId   string
 
+	// Either ovh to use the OVH API, the default, openstack to use the OpenStack APIs or simulator
+	// to use the simulated OVH API
+	Backend string
+
 	// OVH API settings
 	ApplicationKey    string
 	ApplicationSecret string
 	ConsumerKey       string
 	OVHEndpoint       string
+
+	// OpenStack API settings
+	OpenStack OpenStackConfig
+
+	// Seconds to wait for OVH volume operations and the device of an attached volume
+	CreateTimeout int
+	AttachTimeout int
+	DetachTimeout int
+	DeleteTimeout int
+	DeviceTimeout int
+
+	// Seconds an operation may take in total by operation name, e.g. Mount, after which its API
+	// calls and commands are abandoned and an error is returned
+	OperationTimeouts map[string]int
+
+	// Seconds during which OVH or OpenStack API calls failing temporarily, e.g. during maintenance,
+	// are retried
+	APIRetryTimeout int
+
+	// Days before the OVH consumer key expires to start warning about it
+	CredentialExpiryWarning int
+
+	// Seconds a listing of the volumes of the project is reused for, negative to always list them again
+	VolumeCacheTTL int
+
+	// Seconds to wait for OVH to create or delete a snapshot
+	SnapshotTimeout int
+	// Seconds to wait for OVH to grow a volume
+	ResizeTimeout int
+	// Maximum number of seconds a filesystem stays frozen while taking a snapshot
+	FreezeTimeout int
+
+	// Seconds between checks of the filesystem usage of volumes with autogrow enabled
+	AutogrowInterval int
+	AuditLog         string // File logging automatic changes to volumes, in StateDir by default
+
+	AdminSocket string // Unix socket for snapshot management and other administrative commands
+
+	// Scheduled snapshots by Docker volume name, used for volumes created without snapshot options
+	SnapshotPolicies map[string]SnapshotPolicy
+
+	// Keys of encrypted volumes, either key files named <key id>.key in KeyDir or derived from
+	// MasterKey, a key file takes precedence
+	KeyDir    string
+	MasterKey string
 }
 
 type OVHPlugin struct {
-	Mutex  *sync.Mutex
-	Conf   *Config
-	Client *OVHClient
+	Locks   *VolumeLocks
+	Conf    *Config
+	Client  *CloudClient
+	State   *StateStore
+	Metrics *Metrics
+	Mounter Mounter
+
+	Credentials *CredentialMonitor
 }
 
-func processConfig(cfg string) (Config, error) {
+func processConfig(cfg string, managed bool) (Config, error) {
 	var conf Config
 	content, err := ioutil.ReadFile(cfg)
 	if err != nil {
-		log.Fatal("Error reading config file: ", err)
+		// a managed plugin is usually configured via `docker plugin set` rather than a config file
+		if !managed || !os.IsNotExist(err) {
+			log.Fatal("Error reading config file: ", err)
+		}
+		log.Infof("Config file %s not found, using environment settings only", cfg)
+	} else {
+		err = json5.Unmarshal(content, &conf)
+		if err != nil {
+			log.Fatal("Error parsing json config file: ", err)
+		}
 	}
-	err = json5.Unmarshal(content, &conf)
-	if err != nil {
-		log.Fatal("Error parsing json config file: ", err)
+	applyEnvironment(&conf)
+
+	if managed {
+		if conf.MountPoint != "" && conf.MountPoint != MANAGED_MOUNT_POINT {
+			log.Warningf("Ignoring MountPoint %s, managed plugins always mount volumes in %s", conf.MountPoint, MANAGED_MOUNT_POINT)
+		}
+		conf.MountPoint = MANAGED_MOUNT_POINT
 	}
 	if conf.MountPoint == "" {
 		conf.MountPoint = "/var/lib/ovh-volume-plugin/mount"
 	}
+	if conf.StateDir == "" {
+		conf.StateDir = "/var/lib/ovh-volume-plugin/state"
+	}
 	if conf.OVHEndpoint == "" {
 		conf.OVHEndpoint = "ovh-eu"
 	}
@@ -64,22 +169,163 @@ func processConfig(cfg string) (Config, error) {
 	if conf.SocketGroup == "" {
 		conf.SocketGroup = "root"
 	}
-	if conf.DefaultVolSz < 10 {
+	if conf.Backend == "" {
+		conf.Backend = BACKEND_OVH
+	}
+	if conf.DefaultVolSz <= 0 {
 		conf.DefaultVolSz = 10
+	} else if conf.DefaultVolSz < minimumVolumeSize(conf.Backend) {
+		conf.DefaultVolSz = minimumVolumeSize(conf.Backend)
+	}
+	if conf.OpenStack.Region == "" {
+		conf.OpenStack.Region = conf.DefaultRegion
 	}
 	if conf.DefaultVolType == "" {
 		conf.DefaultVolType = VOLUME_TYPE_CLASSIC
 	}
+	for volType, fs := range conf.VolumeTypeDefaults {
+		if fs.FSType != "" && !contains(formattableFilesystems, fs.FSType) {
+			log.Fatalf("Unsupported FSType %s for volume type %s, use one of %s", fs.FSType, volType, strings.Join(formattableFilesystems, ", "))
+		}
+		log.Infof("Set filesystem defaults for %s volumes to: %+v", volType, fs)
+	}
+	for name, policy := range conf.SnapshotPolicies {
+		if _, err := parseSchedule(policy.Schedule); err != nil {
+			log.Fatalf("Invalid snapshot schedule for volume %s: %s", name, err)
+		}
+		if _, err := parseDuration(policy.MaxAge); policy.MaxAge != "" && err != nil {
+			log.Fatalf("Invalid snapshot MaxAge for volume %s: %s", name, err)
+		}
+	}
+	for _, timeout := range []*int{&conf.CreateTimeout, &conf.AttachTimeout, &conf.DetachTimeout, &conf.DeleteTimeout} {
+		if *timeout <= 0 {
+			*timeout = 120
+		}
+	}
+	if conf.DeviceTimeout <= 0 {
+		conf.DeviceTimeout = 60
+	}
+	if conf.OperationTimeouts == nil {
+		conf.OperationTimeouts = map[string]int{}
+	}
+	for operation := range conf.OperationTimeouts {
+		if _, ok := defaultOperationTimeouts[operation]; !ok {
+			log.Warningf("Ignoring the timeout of unknown operation %s in OperationTimeouts", operation)
+		}
+	}
+	for operation, seconds := range defaultOperationTimeouts {
+		if conf.OperationTimeouts[operation] <= 0 {
+			conf.OperationTimeouts[operation] = seconds
+		}
+	}
+	if conf.APIRetryTimeout <= 0 {
+		conf.APIRetryTimeout = 60
+	}
+	if conf.CredentialExpiryWarning <= 0 {
+		conf.CredentialExpiryWarning = 14
+	}
+	if conf.VolumeCacheTTL == 0 {
+		conf.VolumeCacheTTL = 10
+	}
+	if conf.SnapshotTimeout <= 0 {
+		conf.SnapshotTimeout = 600
+	}
+	if conf.ResizeTimeout <= 0 {
+		conf.ResizeTimeout = 300
+	}
+	if conf.FreezeTimeout <= 0 {
+		conf.FreezeTimeout = 60
+	}
+	if conf.AutogrowInterval <= 0 {
+		conf.AutogrowInterval = 60
+	}
+	if conf.AuditLog == "" {
+		conf.AuditLog = filepath.Join(conf.StateDir, "audit.log")
+	}
+	if conf.AdminSocket == "" {
+		conf.AdminSocket = DEFAULT_ADMIN_SOCKET
+	}
 	log.Infof("Using config file: %s", cfg)
 	log.Infof("Set DefaultVolSz to: %d GiB", conf.DefaultVolSz)
 	log.Infof("Set DefaultVolType to: %s", conf.DefaultVolType)
 	log.Infof("Set OVHEndpoint to: %s", conf.OVHEndpoint)
 	log.Infof("Set SocketGroup to: %s", conf.SocketGroup)
+	log.Infof("Set MountPoint to: %s", conf.MountPoint)
+	log.Infof("Set StateDir to: %s", conf.StateDir)
 	return conf, nil
 }
 
-func New(cfgFile string) OVHPlugin {
-	conf, err := processConfig(cfgFile)
+func (c *Config) timeout(seconds int) time.Duration {
+	return time.Duration(seconds) * time.Second
+}
+
+// Returns a context which is done once the timeout of the operation passed
+func (c *Config) operationContext(operation string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.timeout(c.OperationTimeouts[operation]))
+}
+
+// Adds to the error of an operation that it ran out of time, if that is what happened
+func (c *Config) deadlineError(ctx context.Context, operation string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return errors.New(c.deadlineMessage(ctx, operation, err.Error()))
+}
+
+// Adds to the error message of an operation that it ran out of time, if that is what happened
+func (c *Config) deadlineMessage(ctx context.Context, operation, message string) string {
+	if message == "" || ctx.Err() != context.DeadlineExceeded {
+		return message
+	}
+	return fmt.Sprintf("%s. The %s operation did not complete within %d seconds, raise OperationTimeouts.%s if it needs more time",
+		message, strings.ToLower(operation), c.OperationTimeouts[operation], operation)
+}
+
+// Overrides config file settings with the OVH_* environment variables, which is how the settable
+// `env` entries of a managed plugin reach the driver
+func applyEnvironment(conf *Config) {
+	stringSettings := map[string]*string{
+		"OVH_APPLICATION_KEY":    &conf.ApplicationKey,
+		"OVH_APPLICATION_SECRET": &conf.ApplicationSecret,
+		"OVH_CONSUMER_KEY":       &conf.ConsumerKey,
+		"OVH_ENDPOINT":           &conf.OVHEndpoint,
+		"OVH_PROJECT_ID":         &conf.ProjectId,
+		"OVH_SERVER_ID":          &conf.ServerId,
+		"OVH_REGION":             &conf.DefaultRegion,
+		"OVH_VOLUME_TYPE":        &conf.DefaultVolType,
+		"OVH_SOCKET_GROUP":       &conf.SocketGroup,
+		"OVH_KEY_DIR":            &conf.KeyDir,
+		"OVH_MASTER_KEY":         &conf.MasterKey,
+		"OVH_BACKEND":            &conf.Backend,
+		// the variables of an OpenStack RC file
+		"OS_AUTH_URL":            &conf.OpenStack.AuthURL,
+		"OS_USERNAME":            &conf.OpenStack.Username,
+		"OS_PASSWORD":            &conf.OpenStack.Password,
+		"OS_TENANT_ID":           &conf.OpenStack.ProjectId,
+		"OS_PROJECT_ID":          &conf.OpenStack.ProjectId,
+		"OS_TENANT_NAME":         &conf.OpenStack.ProjectName,
+		"OS_PROJECT_NAME":        &conf.OpenStack.ProjectName,
+		"OS_USER_DOMAIN_NAME":    &conf.OpenStack.UserDomainName,
+		"OS_PROJECT_DOMAIN_NAME": &conf.OpenStack.ProjectDomainName,
+		"OS_REGION_NAME":         &conf.OpenStack.Region,
+	}
+	for name, setting := range stringSettings {
+		if value := os.Getenv(name); value != "" {
+			log.Debugf("Using %s from the environment", name)
+			*setting = value
+		}
+	}
+	if value := os.Getenv("OVH_VOLUME_SIZE"); value != "" {
+		if size, err := strconv.Atoi(value); err == nil {
+			conf.DefaultVolSz = size
+		} else {
+			log.Warningf("Ignoring invalid OVH_VOLUME_SIZE %q: %s", value, err)
+		}
+	}
+}
+
+func New(cfgFile string, managed bool) OVHPlugin {
+	conf, err := processConfig(cfgFile, managed)
 	if err != nil {
 		log.Fatal("Error processing OVH docker volume plugin config file: ", err)
 	}
@@ -91,19 +337,34 @@ func New(cfgFile string) OVHPlugin {
 		}
 	}
 
-	ovhClient, err := ovh.NewClient(conf.OVHEndpoint, conf.ApplicationKey, conf.ApplicationSecret, conf.ConsumerKey)
+	state, err := NewStateStore(conf.StateDir)
+	if err != nil {
+		log.Fatalf("Failed to load the volume state from %s: %v", conf.StateDir, err)
+	}
+
+	client, err := NewCloudClient(&conf)
 	if err != nil {
 		log.Fatalf("Error: %q\n", err)
 	}
-	ovhWrapper := OVHClient{Conf: &conf, Client: ovhClient}
+
+	metrics := NewMetrics()
+	credentials := NewCredentialMonitor(&conf, client, metrics)
+	ctx, cancel := conf.operationContext(OPERATION_LIST)
+	credentials.Refresh(ctx)
+	cancel()
 
 	if conf.ServerId == "" {
 		log.Debug("No ServerId configured")
+		if err := credentials.Allows(rightListInstances); err != nil {
+			log.Fatalf("No server id defined and it cannot be looked up: %s. Set ServerId in the config file instead", err)
+		}
 		ips, err := getIpAddresses()
 		if err != nil {
 			log.Fatalf("No server id defined and could not find ip addresses for this server: %s", err)
 		} else {
-			instance, err := ovhWrapper.GetInstanceByIps(ips)
+			ctx, cancel := conf.operationContext(OPERATION_LIST)
+			instance, err := client.GetInstanceByIps(ctx, ips)
+			cancel()
 			if err != nil {
 				log.Fatalf("Could not find the instance matching this server's IP: %s", err.Error())
 			} else {
@@ -114,23 +375,82 @@ func New(cfgFile string) OVHPlugin {
 	}
 
 	d := OVHPlugin{
-		Conf:   &conf,
-		Mutex:  &sync.Mutex{},
-		Client: &ovhWrapper,
+		Conf:    &conf,
+		Locks:   NewVolumeLocks(),
+		Client:  client,
+		State:   state,
+		Metrics: metrics,
+		Mounter: NewMounter(),
+
+		Credentials: credentials,
+	}
+
+	ctx, cancel = conf.operationContext(OPERATION_RECONCILE)
+	defer cancel()
+	if report, err := d.reconcile(ctx); err != nil {
+		log.Errorf("Failed to reconcile the volume state with OVH and the mount table: %s", err)
+	} else {
+		report.log()
 	}
 	log.Debug("Finished driver initialization")
 	return d
 }
 
+// Returns the directory a volume is mounted on. For a managed plugin this is a path inside the
+// propagated mount, which Docker maps to the corresponding location on the host.
+func (d OVHPlugin) mountPath(name string) string {
+	return filepath.Join(d.Conf.MountPoint, name)
+}
+
+// Takes the lock serialising the operations on a volume, giving up once the context is done
+func (d OVHPlugin) lock(ctx context.Context, name string) error {
+	if err := d.Locks.Lock(ctx, name); err != nil {
+		return fmt.Errorf("Gave up waiting for another operation on volume %s to finish: %s", name, err)
+	}
+	return nil
+}
+
+func (d OVHPlugin) unlock(name string) {
+	d.Locks.Unlock(name)
+}
+
+// Looks up the OVH volume backing a Docker volume, by the id stored in the local state when known
+// to avoid listing the whole project. Returns an empty volume if it does not exist.
+func (d OVHPlugin) findVolume(ctx context.Context, name string) (Volume, error) {
+	if vs, ok := d.State.Get(name); ok && vs.Id != "" {
+		vol, err := d.Client.GetVolume(ctx, vs.Id)
+		if err != nil {
+			return vol, err
+		}
+		if vol.Id != "" && vol.Name == name {
+			return vol, nil
+		}
+		log.Warningf("Volume %s no longer exists as %s, looking it up by name", name, vs.Id)
+	}
+
+	vol, err := d.Client.GetVolumeByName(ctx, name)
+	if err != nil || vol.Id == "" {
+		return vol, err
+	}
+	err = d.State.Update(name, func(vs *VolumeState) {
+		vs.Id = vol.Id
+		vs.Region = vol.Region
+	})
+	return vol, err
+}
+
 // Parses the user provided volume creation options and creates an OVH API object
-func (d OVHPlugin) parseOpts(r volume.Request) VolumePost {
+func (d OVHPlugin) parseOpts(ctx context.Context, r *volume.CreateRequest) (VolumePost, error) {
 	opts := VolumePost{
-		Type:        d.Conf.DefaultVolType,
-		Size:        d.Conf.DefaultVolSz,
-		Region:      d.Conf.DefaultRegion,
-		Name:        r.Name,
-		Description: "Docker volume.",
+		Type:   d.Conf.DefaultVolType,
+		Size:   d.Conf.DefaultVolSz,
+		Region: d.Conf.DefaultRegion,
+		Name:   r.Name,
 	}
+	meta := map[string]string{}
+	// options of the volume a snapshot was taken of, which the new volume inherits
+	inherited := map[string]string{}
+	minSize := 0
 	for k, v := range r.Options {
 		log.Debugf("Option: %s = %s", k, v)
 		switch k {
@@ -143,108 +463,328 @@ func (d OVHPlugin) parseOpts(r volume.Request) VolumePost {
 			if r.Options["type"] != "" {
 				opts.Type = v
 			}
+		case OPT_FSTYPE:
+			if !contains(formattableFilesystems, v) {
+				return opts, fmt.Errorf("Unsupported fstype %s, use one of %s", v, strings.Join(formattableFilesystems, ", "))
+			}
+			meta[k] = v
+		case OPT_MKFSOPTS, OPT_MOUNTOPTS:
+			meta[k] = v
+		case OPT_SNAPSHOT_SCHEDULE, OPT_SNAPSHOT_KEEP, OPT_SNAPSHOT_MAX_AGE, OPT_SNAPSHOT_FREEZE:
+			if err := validateSnapshotOption(k, v); err != nil {
+				return opts, fmt.Errorf("Invalid %s: %s", k, err)
+			}
+			meta[k] = v
+		case OPT_AUTOGROW, OPT_AUTOGROW_MAX, OPT_AUTOGROW_STEP:
+			if err := validateAutogrowOption(k, v); err != nil {
+				return opts, fmt.Errorf("Invalid %s: %s", k, err)
+			}
+			meta[k] = v
+		case OPT_FSCK:
+			if err := validateFsckPolicy(v); err != nil {
+				return opts, err
+			}
+			meta[k] = v
+		case OPT_ENCRYPTED:
+			encrypted, err := strconv.ParseBool(v)
+			if err != nil {
+				return opts, fmt.Errorf("Invalid %s: %s", k, err)
+			}
+			if encrypted {
+				meta[k] = "true"
+			}
+		case OPT_KEY_ID:
+			meta[k] = v
+		case "snapshot":
+			snapshot, err := d.findSnapshot(ctx, v)
+			if err != nil {
+				return opts, err
+			}
+			opts.SnapshotId = snapshot.Id
+			opts.Region = snapshot.Region
+			minSize = snapshot.Size
+			source, err := d.Client.GetVolume(ctx, snapshot.VolumeId)
+			if err != nil {
+				return opts, err
+			}
+			if source.Id == "" {
+				log.Warningf("Volume %s of snapshot %s no longer exists, %s does not inherit its options", snapshot.VolumeId, snapshot.Id, r.Name)
+			}
+			inherited = decodeDescription(source.Description)
+		case "image":
+			opts.ImageId = v
+		}
+	}
+	for k, v := range inherited {
+		if _, ok := r.Options[k]; !ok {
+			meta[k] = v
+		}
+	}
+	if opts.Size < minSize {
+		log.Infof("Increasing size of %s to %d GB to fit snapshot %s", r.Name, minSize, opts.SnapshotId)
+		opts.Size = minSize
+	}
+	sources := 0
+	for _, k := range []string{"snapshot", "image", "from"} {
+		if r.Options[k] != "" {
+			sources++
 		}
 	}
-	return opts
+	if sources > 1 {
+		return opts, errors.New("Only one of the snapshot, image and from options can be used")
+	}
+
+	if meta[OPT_ENCRYPTED] == "true" {
+		if r.Options["image"] != "" {
+			return opts, errors.New("Volumes created from an image can not be encrypted")
+		}
+		if d.Conf.KeyDir == "" && d.Conf.MasterKey == "" {
+			return opts, errors.New("Set KeyDir or MasterKey in the config to create encrypted volumes")
+		}
+		if _, ok := meta[OPT_KEY_ID]; !ok {
+			meta[OPT_KEY_ID] = r.Name
+		}
+	} else if _, ok := meta[OPT_KEY_ID]; ok {
+		return opts, fmt.Errorf("%s can only be used for encrypted volumes", OPT_KEY_ID)
+	}
+
+	// store the defaults with the volume as well, so a config change does not affect existing volumes
+	fs := d.Conf.filesystemDefaults(opts.Type)
+	if _, ok := meta[OPT_FSTYPE]; !ok {
+		meta[OPT_FSTYPE] = fs.FSType
+	}
+	if _, ok := meta[OPT_MKFSOPTS]; !ok && fs.MkfsOpts != "" {
+		meta[OPT_MKFSOPTS] = fs.MkfsOpts
+	}
+	if _, ok := meta[OPT_MOUNTOPTS]; !ok && fs.MountOpts != "" {
+		meta[OPT_MOUNTOPTS] = fs.MountOpts
+	}
+	opts.Description = encodeDescription(meta)
+	if err := checkDescription(r.Name, opts.Description); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func (d OVHPlugin) Create(r *volume.CreateRequest) error {
+	ctx, cancel := d.Conf.operationContext(OPERATION_CREATE)
+	defer cancel()
+	return d.Conf.deadlineError(ctx, OPERATION_CREATE, d.create(ctx, r))
 }
 
-func (d OVHPlugin) Create(r volume.Request) volume.Response {
+func (d OVHPlugin) create(ctx context.Context, r *volume.CreateRequest) error {
 	log.Infof("Create volume %s on OVH", r.Name)
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
+	if err := d.lock(ctx, r.Name); err != nil {
+		return fmt.Errorf("Error while creating volume %s, %s", r.Name, errorMessage(err))
+	}
+	defer d.unlock(r.Name)
 
-	vol, err := d.Client.GetVolumeByName(r.Name)
+	vol, err := d.findVolume(ctx, r.Name)
 	if err != nil {
-		log.Errorf("Error while checking if volume %s already exists: %s", vol, err.Error())
-		return volume.Response{Err: fmt.Sprintf("Error while checking if volume %s exists, %s", r.Name, err)}
+		log.Errorf("Error while checking if volume %s already exists: %s", r.Name, err.Error())
+		return fmt.Errorf("Error while checking if volume %s exists, %s", r.Name, errorMessage(err))
 	}
 
 	// volume does not yet exist
 	if vol.Id == "" {
 		log.Infof("Did not find a volume with name %s, creating a new one", r.Name)
-		createVolumeOptions := d.parseOpts(r)
+		if err := d.Credentials.Allows(rightCreateVolume); err != nil {
+			return fmt.Errorf("Error while creating volume %s, %s", r.Name, err)
+		}
+		createVolumeOptions, err := d.parseOpts(ctx, r)
+		if err != nil {
+			return fmt.Errorf("Invalid options for volume %s: %s", r.Name, errorMessage(err))
+		}
+		if from := r.Options["from"]; from != "" {
+			if err := d.Credentials.Allows(rightCreateSnapshot); err != nil {
+				return fmt.Errorf("Error while cloning %s into %s, %s", from, r.Name, err)
+			}
+			snapshot, err := d.snapshotForClone(ctx, from, &createVolumeOptions, r.Options)
+			if err != nil {
+				return fmt.Errorf("Error while cloning %s into %s, %s", from, r.Name, errorMessage(err))
+			}
+			// the snapshot is only needed until the new volume is available
+			defer d.removeCloneSnapshot(snapshot)
+		}
 		log.Debugf("Creating volume with options: %+v", createVolumeOptions)
 
-		if _, err := d.Client.CreateVolume(createVolumeOptions); err != nil {
-			return volume.Response{Err: fmt.Sprintf("Error while creating volume %s, %s", r.Name, err)}
+		created, err := d.Client.CreateVolume(ctx, createVolumeOptions)
+		if err != nil {
+			return fmt.Errorf("Error while creating volume %s, %s", r.Name, errorMessage(err))
+		}
+		err = d.State.Update(r.Name, func(vs *VolumeState) {
+			vs.Id = created.Id
+			vs.Region = createVolumeOptions.Region
+			vs.Options = r.Options
+			vs.Fresh = createVolumeOptions.SnapshotId == "" && createVolumeOptions.ImageId == ""
+		})
+		if err != nil {
+			log.Errorf("Failed to store state of new volume %s: %s", r.Name, err)
+			return errors.New(errorMessage(err))
+		}
+		if _, err := d.Client.WaitForCreate(ctx, created.Id); err != nil {
+			log.Errorf("Volume %s did not become available: %s", r.Name, err)
+			return fmt.Errorf("Error while creating volume %s, %s", r.Name, errorMessage(err))
 		}
 	} else if vol.Status != "available" && !contains(vol.AttachedTo, d.Conf.ServerId) {
-		return volume.Response{Err: fmt.Sprintf("Volume %s already exists and is not available, state is %s", r.Name, vol.Status)}
+		return fmt.Errorf("Volume %s already exists and is not available, state is %s", r.Name, vol.Status)
+	} else {
+		log.Infof("Found an existing volume with name %s, reusing this", r.Name)
+		// a larger size given when creating the volume again grows it
+		if size, err := strconv.Atoi(r.Options["size"]); err == nil && size > vol.Size {
+			if _, err := d.resizeVolume(ctx, r.Name, size); err != nil {
+				log.Errorf("Failed to resize volume %s: %s", r.Name, err)
+				return fmt.Errorf("Error while resizing volume %s, %s", r.Name, errorMessage(err))
+			}
+		}
+		if err := d.updateFsckPolicy(ctx, vol, r); err != nil {
+			log.Errorf("Failed to update the filesystem check policy of volume %s: %s", r.Name, err)
+			return fmt.Errorf("Error while updating volume %s, %s", r.Name, errorMessage(err))
+		}
 	}
-	log.Infof("Found an existing volume with name %s, reusing this", r.Name)
 
 	// create a mount point so we can easily track this volume
-	path := filepath.Join(d.Conf.MountPoint, r.Name)
-	if err := os.Mkdir(path, os.ModeDir); err != nil {
+	path := d.mountPath(r.Name)
+	if err := os.Mkdir(path, os.ModeDir); err != nil && !os.IsExist(err) {
 		log.Errorf("Failed to create Mount directory: %v", err)
-		return volume.Response{Err: err.Error()}
+		return errors.New(errorMessage(err))
+	}
+
+	return nil
+}
+
+// Stores the filesystem check policy given when creating an existing volume again with the volume
+func (d OVHPlugin) updateFsckPolicy(ctx context.Context, vol Volume, r *volume.CreateRequest) error {
+	policy, ok := r.Options[OPT_FSCK]
+	if !ok {
+		return nil
+	}
+	if err := validateFsckPolicy(policy); err != nil {
+		return err
+	}
+	meta := decodeDescription(vol.Description)
+	if meta[OPT_FSCK] == policy {
+		return nil
+	}
+	meta[OPT_FSCK] = policy
+	description := encodeDescription(meta)
+	if err := checkDescription(r.Name, description); err != nil {
+		return err
 	}
+	if err := d.Credentials.Allows(rightUpdateVolume); err != nil {
+		return err
+	}
+	log.Infof("Updating the filesystem check policy of volume %s to %s", r.Name, policy)
+	_, err := d.Client.UpdateVolume(ctx, vol.Id, VolumePut{Name: vol.Name, Description: description})
+	return err
+}
 
-	return volume.Response{}
+func (d OVHPlugin) Remove(r *volume.RemoveRequest) error {
+	ctx, cancel := d.Conf.operationContext(OPERATION_REMOVE)
+	defer cancel()
+	return d.Conf.deadlineError(ctx, OPERATION_REMOVE, d.remove(ctx, r))
 }
 
-func (d OVHPlugin) Remove(r volume.Request) volume.Response {
+func (d OVHPlugin) remove(ctx context.Context, r *volume.RemoveRequest) error {
 	log.Info("Remove/Delete Volume: ", r.Name)
-	vol, err := d.Client.GetVolumeByName(r.Name)
+	if err := d.lock(ctx, r.Name); err != nil {
+		return fmt.Errorf("Failed to delete %s: %s", r.Name, errorMessage(err))
+	}
+	defer d.unlock(r.Name)
+
+	vol, err := d.findVolume(ctx, r.Name)
 	log.Debugf("Remove/Delete Volume ID: %s", vol.Id)
 	if err != nil {
-		log.Errorf("Failed to retrieve volume named: ", r.Name, "during Remove operation", err)
-		return volume.Response{Err: err.Error()}
+		log.Errorf("Failed to retrieve volume named %s during Remove operation: %s", r.Name, err)
+		return errors.New(errorMessage(err))
 	}
 	if vol.Id == "" {
-		return volume.Response{Err: fmt.Sprintf("Volume with name %s could not be found", r.Name)}
+		return fmt.Errorf("Volume with name %s could not be found", r.Name)
 	}
 	if vol.Status == "attaching" || vol.Status == "in-use" {
-		return volume.Response{Err: fmt.Sprintf("Cannot delete %s while in %s state", r.Name, vol.Status)}
+		return fmt.Errorf("Cannot delete %s while in %s state", r.Name, vol.Status)
+	}
+	if err := d.Credentials.Allows(rightDeleteVolume); err != nil {
+		return fmt.Errorf("Failed to delete %s: %s", r.Name, err)
+	}
+	if err := d.Client.DeleteVolume(ctx, vol.Id); err != nil {
+		return fmt.Errorf("Failed to delete %s: %s", r.Name, errorMessage(err))
+	}
+	if err := d.Client.WaitForDelete(ctx, vol.Id); err != nil {
+		return fmt.Errorf("Failed to delete %s: %s", r.Name, errorMessage(err))
 	}
-	if err := d.Client.DeleteVolume(vol.Id); err != nil {
-		return volume.Response{Err: fmt.Sprintf("Failed to delete %s: %s", r.Name, err.Error())}
+	if err := d.State.Delete(r.Name); err != nil {
+		log.Errorf("Failed to remove volume %s from the state: %s", r.Name, err)
+		return errors.New(errorMessage(err))
 	}
 
-	path := filepath.Join(d.Conf.MountPoint, r.Name)
+	path := d.mountPath(r.Name)
 	if err := os.Remove(path); err != nil {
 		log.Errorf("Failed to remove Mount directory: %v", err)
-		return volume.Response{Err: err.Error()}
+		return errors.New(errorMessage(err))
 	}
-	return volume.Response{}
+	return nil
 }
 
-func (d OVHPlugin) Path(r volume.Request) volume.Response {
+func (d OVHPlugin) Path(r *volume.PathRequest) (*volume.PathResponse, error) {
 	log.Info("Retrieve path info for volume: `", r.Name, "`")
-	path := filepath.Join(d.Conf.MountPoint, r.Name)
+	path := d.mountPath(r.Name)
 	log.Debug("Path reported as: ", path)
-	return volume.Response{Mountpoint: path}
+	return &volume.PathResponse{Mountpoint: path}, nil
 }
 
-func (d OVHPlugin) Mount(r volume.Request) volume.Response {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
+func (d OVHPlugin) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
+	ctx, cancel := d.Conf.operationContext(OPERATION_MOUNT)
+	defer cancel()
+	res, err := d.mount(ctx, r)
+	return res, d.Conf.deadlineError(ctx, OPERATION_MOUNT, err)
+}
+
+func (d OVHPlugin) mount(ctx context.Context, r *volume.MountRequest) (*volume.MountResponse, error) {
+	if err := d.lock(ctx, r.Name); err != nil {
+		return nil, errors.New(errorMessage(err))
+	}
+	defer d.unlock(r.Name)
 
 	hostname, _ := os.Hostname()
 	log.Infof("Mounting volume %+v on %s", r, hostname)
-	vol, err := d.Client.GetVolumeByName(r.Name)
+
+	// another container on this server already uses the volume, so it is attached and mounted
+	if count := d.State.MountCount(r.Name); count > 0 {
+		log.Infof("Volume %s is already mounted for %d other container(s)", r.Name, count)
+		if err := d.State.AddMount(r.Name, r.ID); err != nil {
+			log.Errorf("Failed to store mount %s of volume %s: %s", r.ID, r.Name, err)
+			return nil, errors.New(errorMessage(err))
+		}
+		return &volume.MountResponse{Mountpoint: d.mountPath(r.Name)}, nil
+	}
+
+	vol, err := d.findVolume(ctx, r.Name)
 	if err != nil {
-		log.Errorf("Failed to retrieve volume named: ", r.Name, "during Mount operation", err)
-		return volume.Response{Err: err.Error()}
+		log.Errorf("Failed to retrieve volume named %s during Mount operation: %s", r.Name, err)
+		return nil, errors.New(errorMessage(err))
 	}
 	if vol.Id == "" {
-		return volume.Response{Err: fmt.Sprintf("Volume with name %s could not be found", r.Name)}
+		return nil, fmt.Errorf("Volume with name %s could not be found", r.Name)
 	}
-	if vol.Status == "creating" {
+	switch vol.Status {
+	case "creating":
 		// NOTE(jdg):  This may be a successive call after a create which from
-		// the docker volume api can be quite speedy.  Take a short pause and
-		// check the status again before proceeding
-		time.Sleep(time.Second * 5)
-		vol, err = d.Client.GetVolumeByName(r.Name)
+		// the docker volume api can be quite speedy.
+		vol, err = d.Client.WaitForCreate(ctx, vol.Id)
+	case "attaching":
+		vol, err = d.Client.WaitForAttach(ctx, vol.Id)
+	case "detaching":
+		// the previous user is still letting go of the volume
+		vol, err = d.Client.WaitForDetach(ctx, vol.Id)
 	}
-
 	if err != nil {
-		log.Errorf("Failed to retrieve volume named: ", r.Name, "during Mount operation", err)
-		return volume.Response{Err: err.Error()}
+		log.Errorf("Volume %s did not reach a usable state during Mount operation: %s", r.Name, err)
+		return nil, errors.New(errorMessage(err))
 	}
 
 	volumeIsAttachedToServer := contains(vol.AttachedTo, d.Conf.ServerId)
-	if (vol.Status == "in-use" || vol.Status == "attaching") && volumeIsAttachedToServer {
+	if vol.Status == "in-use" && volumeIsAttachedToServer {
 		// disk is already attached, we can skip the pleasantries
 		log.Infof("Disk %s is already attached to %s", vol.Id, d.Conf.ServerId)
 	} else if vol.Status != "available" {
@@ -252,110 +792,296 @@ func (d OVHPlugin) Mount(r volume.Request) volume.Response {
 		errMsg := fmt.Sprintf("Invalid volume status for mount request, volume is: %s but must be available", vol.Status)
 		log.Error(errMsg)
 		err := errors.New(errMsg)
-		return volume.Response{Err: err.Error()}
+		return nil, errors.New(errorMessage(err))
 	}
 
 	// only if the volume is not yet attached, attach it
+	resolver := NewDeviceResolver(d.Conf.Backend == BACKEND_SIMULATOR)
 	if !volumeIsAttachedToServer {
-		if _, err := d.Client.AttachVolume(vol.Id); err != nil {
+		if err := d.Credentials.Allows(rightAttachVolume); err != nil {
+			return nil, fmt.Errorf("Cannot mount volume %s: %s", r.Name, err)
+		}
+		if _, err := d.Client.AttachVolume(ctx, vol.Id); err != nil {
 			fmt.Printf("Error: %q\n", err)
-			return volume.Response{Err: err.Error()}
+			return nil, errors.New(errorMessage(err))
 		}
 	}
 
-	fileName := "/dev/disk/by-id/*" + vol.Id[0:20]
-	var device string
-	if device = waitForPathToExist(fileName, 60); device == "" {
-		return volume.Response{Err: fmt.Sprintf("Waited 60 seconds for volume %s, as device %s, to appear but it never did", vol.Id, device)}
+	device, err := resolver.Resolve(ctx, vol, d.Conf.timeout(d.Conf.DeviceTimeout))
+	if err != nil {
+		log.Error(err)
+		return nil, errors.New(errorMessage(err))
 	}
-	if GetFSType(device) == "" {
-		//TODO(jdg): Enable selection of *other* fs types
-		log.Debugf("Formatting device")
-		err := FormatVolume(device, "ext4")
-		if err != nil {
-			err := errors.New("Failed to format device")
+	if isEncrypted(vol) {
+		if device, err = d.openEncrypted(ctx, r.Name, vol, device); err != nil {
 			log.Error(err)
-			return volume.Response{Err: err.Error()}
+			return nil, errors.New(errorMessage(err))
 		}
 	}
+	fsType, err := d.prepareDevice(ctx, r.Name, vol, device)
+	if err != nil {
+		log.Error(err)
+		return nil, errors.New(errorMessage(err))
+	}
 	// check if the drive is already present
-	if volumeIsAttachedToServer && waitForPathToExist(d.Conf.MountPoint+"/"+r.Name, 1) != "" {
+	mounted, err := d.Mounter.IsMounted(d.mountPath(r.Name))
+	if err != nil {
+		log.Errorf("Could not determine whether volume %s is mounted: %s", r.Name, err)
+		return nil, errors.New(errorMessage(err))
+	}
+	if volumeIsAttachedToServer && mounted {
 		log.Infof("Volume already mounted")
-		return volume.Response{Mountpoint: d.Conf.MountPoint + "/" + r.Name}
 
-		// mount the disk
-	} else if mountErr := Mount(device, d.Conf.MountPoint+"/"+r.Name); mountErr != nil {
+		// check and mount the disk
+	} else if err := d.checkBeforeMount(ctx, r.Name, vol, device, fsType); err != nil {
+		log.Error(err)
+		return nil, errors.New(errorMessage(err))
+	} else if mountErr := d.Mounter.Mount(device, d.mountPath(r.Name), fsType, d.Conf.filesystemOptions(vol).MountOpts); mountErr != nil {
 		err := errors.New("Problem mounting docker volume: " + mountErr.Error())
 		log.Error(err)
-		return volume.Response{Err: err.Error()}
+		return nil, errors.New(errorMessage(err))
+	}
+
+	// the volume may have been grown while it was not mounted here
+	if err := GrowFilesystem(ctx, device, d.mountPath(r.Name), fsType); err != nil {
+		log.Warningf("Failed to grow the filesystem of %s to the size of its device: %s", r.Name, err)
+	}
+
+	err = d.State.Update(r.Name, func(vs *VolumeState) {
+		vs.Device = device
+		vs.FSType = fsType
+		vs.Mounted = true
+	})
+	if err == nil {
+		err = d.State.AddMount(r.Name, r.ID)
+	}
+	if err != nil {
+		log.Errorf("Failed to store mount %s of volume %s: %s", r.ID, r.Name, err)
+		return nil, errors.New(errorMessage(err))
+	}
+	return &volume.MountResponse{Mountpoint: d.mountPath(r.Name)}, nil
+}
+
+// Makes sure the device holds a filesystem we can mount, formatting it only when it is known to
+// be blank or was just created by the plugin, and returns the filesystem type
+func (d OVHPlugin) prepareDevice(ctx context.Context, name string, vol Volume, device string) (string, error) {
+	vs, _ := d.State.Get(name)
+	probe, err := probeDevice(ctx, device)
+	switch {
+	case err == nil && probe.IsMountable():
+		if vs.Fresh {
+			d.State.Update(name, func(vs *VolumeState) { vs.Fresh = false })
+		}
+		return probe.FSType, nil
+	case err != nil && !vs.Fresh:
+		return "", fmt.Errorf("Could not determine whether device %s of volume %s holds data, refusing to format it: %s", device, name, err)
+	case err == nil && !probe.Blank:
+		return "", fmt.Errorf("Device %s of volume %s contains %s, refusing to format or mount it", device, name, probe.Describe())
+	}
+
+	if err != nil {
+		log.Warningf("Probing device %s failed (%s), formatting it anyway since volume %s was just created", device, err, name)
 	}
+	fs := d.Conf.filesystemOptions(vol)
+	log.Debugf("Formatting device %s of volume %s (%s) as %s", device, name, vol.Id, fs.FSType)
+	if err := FormatVolume(ctx, device, fs.FSType, fs.MkfsOpts); err != nil {
+		return "", fmt.Errorf("Failed to format device %s: %s", device, err)
+	}
+	if err := d.State.Update(name, func(vs *VolumeState) { vs.Fresh = false }); err != nil {
+		return "", err
+	}
+	return fs.FSType, nil
+}
 
-	return volume.Response{Mountpoint: d.Conf.MountPoint + "/" + r.Name}
+func (d OVHPlugin) Unmount(r *volume.UnmountRequest) error {
+	ctx, cancel := d.Conf.operationContext(OPERATION_UNMOUNT)
+	defer cancel()
+	return d.Conf.deadlineError(ctx, OPERATION_UNMOUNT, d.unmount(ctx, r))
 }
 
-func (d OVHPlugin) Unmount(r volume.Request) volume.Response {
+func (d OVHPlugin) unmount(ctx context.Context, r *volume.UnmountRequest) error {
 	log.Infof("Unmounting volume: %+v", r)
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
-	vol, err := d.Client.GetVolumeByName(r.Name)
+	if err := d.lock(ctx, r.Name); err != nil {
+		return errors.New(errorMessage(err))
+	}
+	defer d.unlock(r.Name)
+
+	remaining, err := d.State.RemoveMount(r.Name, r.ID)
+	if err != nil {
+		log.Errorf("Failed to remove mount %s of volume %s from the state: %s", r.ID, r.Name, err)
+		return errors.New(errorMessage(err))
+	}
+	if remaining > 0 {
+		log.Infof("Volume %s is still used by %d other container(s), leaving it mounted", r.Name, remaining)
+		return nil
+	}
+
+	vol, err := d.findVolume(ctx, r.Name)
 	if err != nil {
-		log.Errorf("Failed to retrieve volume named: `", r.Name, "` during Unmount operation", err)
-		return volume.Response{Err: err.Error()}
+		log.Errorf("Failed to retrieve volume named `%s` during Unmount operation: %s", r.Name, err)
+		return errors.New(errorMessage(err))
 	}
 	if vol.Id == "" {
 		log.Infof("Volume with name %s could not be found, we're done here", r.Name)
-		return volume.Response{Err: fmt.Sprintf("Volume with name %s could not be found", r.Name)}
+		return fmt.Errorf("Volume with name %s could not be found", r.Name)
 	}
 
-	if umountErr := Umount(d.Conf.MountPoint + "/" + r.Name); umountErr != nil {
-		if umountErr.Error() == "Volume is not mounted" {
+	if umountErr := d.Mounter.Unmount(d.mountPath(r.Name)); umountErr != nil {
+		if _, notMounted := umountErr.(*NotMountedError); notMounted {
 			log.Warning("Request to unmount volume, but it's not mounted")
-			return volume.Response{}
+			if err := d.State.Update(r.Name, func(vs *VolumeState) { vs.Mounted = false }); err != nil {
+				return errors.New(errorMessage(err))
+			}
+			if err := d.closeEncrypted(r.Name); err != nil {
+				return errors.New(errorMessage(err))
+			}
+			return nil
 		} else {
-			return volume.Response{Err: umountErr.Error()}
+			return umountErr
 		}
 	}
+	if err := d.State.Update(r.Name, func(vs *VolumeState) { vs.Mounted = false }); err != nil {
+		return errors.New(errorMessage(err))
+	}
+	// the mapping keeps the device busy, so it has to be closed before detaching
+	if err := d.closeEncrypted(r.Name); err != nil {
+		log.Error(err)
+		return errors.New(errorMessage(err))
+	}
 
-	if _, err := d.Client.DetachVolume(vol.Id); err != nil {
-		return volume.Response{Err: err.Error()}
+	// the volume is unmounted, so the container can stop even if the volume cannot be detached
+	if err := d.Credentials.Allows(rightDetachVolume); err != nil {
+		log.Warningf("Leaving volume %s attached to this server: %s", r.Name, err)
+		return nil
 	}
+	if _, err := d.Client.DetachVolume(ctx, vol.Id); err != nil {
+		return errors.New(errorMessage(err))
+	}
+	if err := d.State.Update(r.Name, func(vs *VolumeState) { vs.Device = "" }); err != nil {
+		return errors.New(errorMessage(err))
+	}
+
+	return nil
+}
 
-	return volume.Response{}
+func (d OVHPlugin) Capabilities() *volume.CapabilitiesResponse {
+	return &volume.CapabilitiesResponse{Capabilities: volume.Capability{Scope: "global"}}
 }
 
-func (d OVHPlugin) Capabilities(r volume.Request) volume.Response {
-	return volume.Response{Capabilities: volume.Capability{Scope: "global"}}
+func (d OVHPlugin) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
+	ctx, cancel := d.Conf.operationContext(OPERATION_GET)
+	defer cancel()
+	res, err := d.get(ctx, r)
+	return res, d.Conf.deadlineError(ctx, OPERATION_GET, err)
 }
 
-func (d OVHPlugin) Get(r volume.Request) volume.Response {
+func (d OVHPlugin) get(ctx context.Context, r *volume.GetRequest) (*volume.GetResponse, error) {
 	log.Info("Get volume: ", r.Name)
-	vol, err := d.Client.GetVolumeByName(r.Name)
+	if err := d.lock(ctx, r.Name); err != nil {
+		return nil, errors.New(errorMessage(err))
+	}
+	defer d.unlock(r.Name)
+
+	vol, err := d.findVolume(ctx, r.Name)
 	if err != nil {
 		log.Errorf("Failed to retrieve volume `%s`: %s", r.Name, err.Error())
-		return volume.Response{Err: err.Error()}
+		return nil, errors.New(errorMessage(err))
 	}
 	if vol.Id == "" {
-		return volume.Response{Err: fmt.Sprintf("Volume with name %s could not be found", r.Name)}
+		return nil, fmt.Errorf("Volume with name %s could not be found", r.Name)
 	}
 
 	// NOTE(jdg): Volume can exist but not necessarily be attached, this just
 	// gets the volume object and where it "would" be attached, it may or may
 	// not currently be attached, but we don't care here
-	path := filepath.Join(d.Conf.MountPoint, r.Name)
+	path := d.mountPath(r.Name)
+
+	var instanceNames map[string]string
+	if len(vol.AttachedTo) > 0 {
+		instanceNames = d.instanceNames(ctx)
+	}
+	return &volume.GetResponse{Volume: d.dockerVolume(vol, path, instanceNames)}, nil
+}
 
-	return volume.Response{Volume: &volume.Volume{Name: r.Name, Mountpoint: path}}
+func (d OVHPlugin) List() (*volume.ListResponse, error) {
+	ctx, cancel := d.Conf.operationContext(OPERATION_LIST)
+	defer cancel()
+	res, err := d.list(ctx)
+	return res, d.Conf.deadlineError(ctx, OPERATION_LIST, err)
 }
 
-func (d OVHPlugin) List(r volume.Request) volume.Response {
-	log.Info("List volumes: ", r.Name)
-	volumes, err := d.Client.ListVolumes()
+func (d OVHPlugin) list(ctx context.Context) (*volume.ListResponse, error) {
+	log.Info("List volumes")
+	volumes, err := d.Client.ListVolumes(ctx)
 	if err != nil {
-		return volume.Response{Err: err.Error()}
+		return nil, errors.New(errorMessage(err))
 	}
 
+	instanceNames := d.instanceNames(ctx)
 	var vols []*volume.Volume
 	for _, v := range volumes {
-		vols = append(vols, &volume.Volume{Name: v.Name, Mountpoint: filepath.Join(d.Conf.MountPoint, v.Name)})
+		vols = append(vols, d.dockerVolume(v, d.mountPath(v.Name), instanceNames))
+	}
+	return &volume.ListResponse{Volumes: vols}, nil
+}
+
+// Converts an OVH volume to the Docker representation, including the OVH details and local mount
+// state shown by `docker volume inspect`
+func (d OVHPlugin) dockerVolume(vol Volume, path string, instanceNames map[string]string) *volume.Volume {
+	status := map[string]interface{}{
+		"id":         vol.Id,
+		"region":     vol.Region,
+		"type":       vol.Type,
+		"size":       vol.Size,
+		"status":     vol.Status,
+		"attachedTo": vol.AttachedTo,
+		"encrypted":  isEncrypted(vol),
+	}
+	if instanceNames != nil {
+		var names []string
+		for _, id := range vol.AttachedTo {
+			if name, ok := instanceNames[id]; ok {
+				names = append(names, name)
+			} else {
+				names = append(names, id)
+			}
+		}
+		status["attachedToNames"] = names
+	}
+
+	if vs, ok := d.State.Get(vol.Name); ok {
+		status["fstype"] = vs.FSType
+		status["device"] = vs.Device
+		status["mounted"] = vs.Mounted
+		status["mountCount"] = len(vs.MountIDs)
+		if vs.LastFsck != nil {
+			status["fsck"] = vs.LastFsck
+		}
+	} else {
+		status["mounted"] = false
+	}
+
+	createdAt := vol.CreationDate
+	if created, err := time.Parse(time.RFC3339, vol.CreationDate); err == nil {
+		createdAt = created.Format(time.RFC3339)
+	}
+	return &volume.Volume{Name: vol.Name, Mountpoint: path, CreatedAt: createdAt, Status: status}
+}
+
+// Returns the names of the instances in the project by id, or nil if they cannot be listed, for
+// example because the API token is not allowed to
+func (d OVHPlugin) instanceNames(ctx context.Context) map[string]string {
+	if d.Credentials.Allows(rightListInstances) != nil {
+		return nil
+	}
+	instances, err := d.Client.ListInstances(ctx)
+	if err != nil {
+		log.Debugf("Not including instance names, could not list instances: %s", err)
+		return nil
+	}
+	names := map[string]string{}
+	for _, instance := range instances {
+		names[instance.Id] = instance.Name
 	}
-	return volume.Response{Volumes: vols}
+	return names
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Volume option key of the filesystem check policy
+const OPT_FSCK = "fsck"
+
+// Filesystem check policies
+const (
+	FSCK_NEVER  = "never"  // mount without checking
+	FSCK_AUTO   = "auto"   // check ext filesystems marked dirty and fix what is safe to fix, the default
+	FSCK_ALWAYS = "always" // check without changing anything, refusing to mount on errors
+	FSCK_REPAIR = "repair" // check and repair everything
+)
+
+var fsckPolicies = []string{FSCK_NEVER, FSCK_AUTO, FSCK_ALWAYS, FSCK_REPAIR}
+
+// Number of output lines of a check kept in the state and included in the mount error
+const (
+	fsckOutputLines = 100
+	fsckErrorLines  = 20
+)
+
+// Result of the last filesystem check of a volume
+type FsckResult struct {
+	Time     time.Time
+	Policy   string
+	Command  string
+	ExitCode int
+	Ok       bool
+	Output   string
+}
+
+// Validates the fsck volume option
+func validateFsckPolicy(policy string) error {
+	if !contains(fsckPolicies, policy) {
+		return fmt.Errorf("Unsupported fsck policy %s, use one of %s", policy, strings.Join(fsckPolicies, ", "))
+	}
+	return nil
+}
+
+// Returns the filesystem check policy of a volume
+func fsckPolicy(vol Volume) string {
+	if policy := decodeDescription(vol.Description)[OPT_FSCK]; contains(fsckPolicies, policy) {
+		return policy
+	}
+	return FSCK_AUTO
+}
+
+// Returns the command checking the filesystem according to the policy, or nil if no check is needed
+func fsckCommand(policy, device, fsType string) []string {
+	ext := strings.HasPrefix(fsType, "ext")
+	switch {
+	case policy == FSCK_NEVER:
+		return nil
+	case ext && policy == FSCK_AUTO:
+		// preen mode skips clean filesystems and only fixes problems that are safe to fix
+		return []string{"e2fsck", "-p", device}
+	case ext && policy == FSCK_ALWAYS:
+		return []string{"e2fsck", "-f", "-n", device}
+	case ext && policy == FSCK_REPAIR:
+		return []string{"e2fsck", "-f", "-y", device}
+	case fsType == "xfs" && policy == FSCK_ALWAYS:
+		return []string{"xfs_repair", "-n", device}
+	case fsType == "xfs" && policy == FSCK_REPAIR:
+		return []string{"xfs_repair", device}
+	case fsType == "btrfs" && (policy == FSCK_ALWAYS || policy == FSCK_REPAIR):
+		// btrfs check --repair may cause further damage, so it is never run automatically
+		return []string{"btrfs", "check", "--readonly", device}
+	}
+	// xfs and btrfs recover from an unclean shutdown when mounted
+	return nil
+}
+
+// Checks the filesystem on the device according to the policy of the volume, returning nil if no
+// check was needed. The device must not be mounted. Only read-only checks are stopped when the
+// context is done, killing a check that is fixing the filesystem could leave it worse off.
+func checkFilesystem(ctx context.Context, vol Volume, device, fsType string) *FsckResult {
+	policy := fsckPolicy(vol)
+	args := fsckCommand(policy, device, fsType)
+	if args == nil {
+		log.Debugf("No filesystem check needed for %s on %s with policy %s", fsType, device, policy)
+		return nil
+	}
+
+	log.Infof("Checking %s filesystem of %s on %s with policy %s", fsType, vol.Name, device, policy)
+	result := &FsckResult{Time: time.Now().UTC(), Policy: policy, Command: strings.Join(args, " ")}
+	if policy == FSCK_AUTO || policy == FSCK_REPAIR {
+		ctx = context.Background()
+	}
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	result.Output = lastLines(strings.TrimSpace(string(out)), fsckOutputLines)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+	} else if err != nil {
+		result.ExitCode = -1
+		result.Output = err.Error()
+	}
+	// e2fsck exits with 1 or 2 when it corrected errors, 4 and up when errors remain
+	result.Ok = result.ExitCode == 0 || (args[0] == "e2fsck" && policy != FSCK_ALWAYS && result.ExitCode > 0 && result.ExitCode < 4)
+	log.Debugf("Result of %s (exit code %d): %s", result.Command, result.ExitCode, result.Output)
+	if result.Ok && result.ExitCode != 0 {
+		log.Warningf("Repaired the filesystem of %s: %s", vol.Name, result.Output)
+	}
+	return result
+}
+
+// Describes a failed check for the mount error, with the last lines of its output
+func (r FsckResult) Error() string {
+	hint := fmt.Sprintf("Create the volume again with `-o %s=%s` to attempt a repair", OPT_FSCK, FSCK_REPAIR)
+	if r.Policy == FSCK_REPAIR {
+		hint = "Repair the filesystem manually"
+	}
+	return fmt.Sprintf("Filesystem check `%s` failed with exit code %d, not mounting the volume. %s. Output:\n%s",
+		r.Command, r.ExitCode, hint, lastLines(r.Output, fsckErrorLines))
+}
+
+func lastLines(s string, n int) string {
+	lines := strings.Split(s, "\n")
+	if len(lines) <= n {
+		return s
+	}
+	return strings.Join(append([]string{"..."}, lines[len(lines)-n:]...), "\n")
+}
+
+// Checks the filesystem of a volume before mounting it, recording the result in the state.
+// Returns an error if the check failed.
+func (d OVHPlugin) checkBeforeMount(ctx context.Context, name string, vol Volume, device, fsType string) error {
+	result := checkFilesystem(ctx, vol, device, fsType)
+	if result == nil {
+		return nil
+	}
+	if err := d.State.Update(name, func(vs *VolumeState) { vs.LastFsck = result }); err != nil {
+		return err
+	}
+	if !result.Ok {
+		return result
+	}
+	return nil
+}
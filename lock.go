@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Mutex that can be given up on while waiting for it, so an operation stuck behind another one
+// still returns once its deadline passed
+type ContextMutex struct {
+	ch chan struct{}
+}
+
+func NewContextMutex() *ContextMutex {
+	return &ContextMutex{ch: make(chan struct{}, 1)}
+}
+
+// Acquires the mutex, or returns the error of the context if it is done first
+func (m *ContextMutex) Lock(ctx context.Context) error {
+	select {
+	case m.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *ContextMutex) Unlock() {
+	<-m.ch
+}
+
+// Locks by Docker volume name, serialising the operations on a volume while operations on
+// different volumes run in parallel
+type VolumeLocks struct {
+	mutex *sync.Mutex
+	locks map[string]*volumeLock
+}
+
+type volumeLock struct {
+	mutex *ContextMutex
+	// number of operations holding or waiting for the lock, it is dropped when none are left
+	users int
+}
+
+func NewVolumeLocks() *VolumeLocks {
+	return &VolumeLocks{mutex: &sync.Mutex{}, locks: map[string]*volumeLock{}}
+}
+
+// Acquires the lock of the volume, or returns the error of the context if it is done first
+func (l *VolumeLocks) Lock(ctx context.Context, name string) error {
+	l.mutex.Lock()
+	lock, ok := l.locks[name]
+	if !ok {
+		lock = &volumeLock{mutex: NewContextMutex()}
+		l.locks[name] = lock
+	}
+	lock.users++
+	l.mutex.Unlock()
+
+	if err := lock.mutex.Lock(ctx); err != nil {
+		l.release(name, lock)
+		return err
+	}
+	return nil
+}
+
+func (l *VolumeLocks) Unlock(name string) {
+	l.mutex.Lock()
+	lock := l.locks[name]
+	l.mutex.Unlock()
+	lock.mutex.Unlock()
+	l.release(name, lock)
+}
+
+func (l *VolumeLocks) release(name string, lock *volumeLock) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lock.users--
+	if lock.users == 0 {
+		delete(l.locks, name)
+	}
+}
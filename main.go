@@ -16,6 +16,13 @@ func main() {
 	showVersion := flag.Bool("version", false, "Display version number of plugin and exit")
 	cfgFile := flag.String("config", "/etc/ovh-docker-config.json", "path to config file")
 	debug := flag.Bool("debug", true, "enable/disable debug logging")
+	managed := flag.Bool("managed", false, "run as a managed Docker plugin (v2 plugin API), configured via the environment")
+	adminSocket := flag.String("admin-socket", "", "admin socket of the running plugin, used by the subcommands (default AdminSocket of the config file, or "+DEFAULT_ADMIN_SOCKET+")")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [<command>]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(os.Stderr, "\n"+usage)
+	}
 	flag.Parse()
 
 	if *debug == true {
@@ -29,8 +36,22 @@ func main() {
 		os.Exit(0)
 	}
 
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(*cfgFile, *adminSocket, flag.Args()))
+	}
+
 	log.Info("Starting ovh-docker-volume-plugin version: ", VERSION)
-	d := New(*cfgFile)
+	d := New(*cfgFile, *managed)
+	go func() {
+		log.Error("Admin socket stopped: ", serveAdmin(d))
+	}()
+	go d.Credentials.Run()
+	go NewSnapshotScheduler(d).Run()
+	go NewAutogrowWatcher(d).Run()
+	gid, err := socketGroupId(d.Conf.SocketGroup)
+	if err != nil {
+		log.Fatalf("Invalid SocketGroup: %s", err)
+	}
 	h := volume.NewHandler(d)
-	log.Info(h.ServeUnix(d.Conf.SocketGroup, "ovh"))
+	log.Info(h.ServeUnix("ovh", gid))
 }
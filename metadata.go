@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Description of the volumes created by the plugin. The options of a volume are stored as JSON
+// after it, so every server mounting the volume applies the same settings.
+const DESCRIPTION_PREFIX = "Docker volume."
+
+// Maximum number of characters of a volume description, both OVH and Cinder reject longer ones
+const MAX_DESCRIPTION_LENGTH = 255
+
+// Volume option keys stored in the description
+const (
+	OPT_FSTYPE    = "fstype"
+	OPT_MKFSOPTS  = "mkfsopts"
+	OPT_MOUNTOPTS = "mountopts"
+)
+
+// Filesystems the plugin is able to create
+var formattableFilesystems = []string{"ext4", "xfs", "btrfs"}
+
+// Filesystem settings of a volume, also used for the per volume type defaults in the config file
+type FilesystemOptions struct {
+	FSType    string // filesystem created on new volumes, ext4 by default
+	MkfsOpts  string // extra arguments for mkfs
+	MountOpts string // comma separated mount options, e.g. noatime,discard
+}
+
+// Builds the OVH volume description holding the given volume metadata
+func encodeDescription(meta map[string]string) string {
+	if len(meta) == 0 {
+		return DESCRIPTION_PREFIX
+	}
+	content, err := json.Marshal(meta)
+	if err != nil {
+		log.Errorf("Failed to encode volume metadata %v: %s", meta, err)
+		return DESCRIPTION_PREFIX
+	}
+	return DESCRIPTION_PREFIX + " " + string(content)
+}
+
+// Returns an error if the description holding the options of a volume is too long to be stored
+func checkDescription(name, description string) error {
+	if length := utf8.RuneCountInString(description); length > MAX_DESCRIPTION_LENGTH {
+		return fmt.Errorf("The options of volume %s take %d characters when stored with the volume, more than the %d allowed. Use shorter mountopts or mkfsopts, or fewer options",
+			name, length, MAX_DESCRIPTION_LENGTH)
+	}
+	return nil
+}
+
+// Extracts the volume metadata from an OVH volume description, volumes created by older versions
+// of the plugin or outside of it have none
+func decodeDescription(description string) map[string]string {
+	meta := map[string]string{}
+	start := strings.Index(description, "{")
+	if !strings.HasPrefix(description, DESCRIPTION_PREFIX) || start < 0 {
+		return meta
+	}
+	if err := json.Unmarshal([]byte(description[start:]), &meta); err != nil {
+		log.Warningf("Ignoring invalid volume metadata in description %q: %s", description, err)
+		return map[string]string{}
+	}
+	return meta
+}
+
+// Returns the filesystem settings of a volume, falling back to the defaults of its volume type for
+// settings that were not stored when it was created
+func (c *Config) filesystemOptions(vol Volume) FilesystemOptions {
+	fs := c.filesystemDefaults(vol.Type)
+	meta := decodeDescription(vol.Description)
+	if v, ok := meta[OPT_FSTYPE]; ok {
+		fs.FSType = v
+	}
+	if v, ok := meta[OPT_MKFSOPTS]; ok {
+		fs.MkfsOpts = v
+	}
+	if v, ok := meta[OPT_MOUNTOPTS]; ok {
+		fs.MountOpts = v
+	}
+	return fs
+}
+
+// Returns the configured filesystem defaults of a volume type
+func (c *Config) filesystemDefaults(volType string) FilesystemOptions {
+	fs := c.VolumeTypeDefaults[volType]
+	if fs.FSType == "" {
+		fs.FSType = "ext4"
+	}
+	return fs
+}
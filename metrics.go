@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Minimal registry of counters and gauges, exposed in the Prometheus text format on the admin socket
+type Metrics struct {
+	mutex  *sync.Mutex
+	help   map[string]string
+	kinds  map[string]string
+	values map[string]map[string]float64 // metric name -> rendered labels -> value
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		mutex:  &sync.Mutex{},
+		help:   map[string]string{},
+		kinds:  map[string]string{},
+		values: map[string]map[string]float64{},
+	}
+}
+
+// Registers a metric with its type (counter or gauge) and help text
+func (m *Metrics) Describe(name, kind, help string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.kinds[name] = kind
+	m.help[name] = help
+	if m.values[name] == nil {
+		m.values[name] = map[string]float64{}
+	}
+}
+
+// Adds delta to the metric with the given label pairs, e.g. Add("x_total", 1, "volume", "db")
+func (m *Metrics) Add(name string, delta float64, labels ...string) {
+	m.update(name, labels, func(v float64) float64 { return v + delta })
+}
+
+// Sets the metric with the given label pairs to value
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+	m.update(name, labels, func(float64) float64 { return value })
+}
+
+func (m *Metrics) update(name string, labels []string, fn func(float64) float64) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	key := strings.Join(pairs, ",")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = map[string]float64{}
+	}
+	m.values[name][key] = fn(m.values[name][key])
+}
+
+// Writes all metrics in the Prometheus text exposition format
+func (m *Metrics) Write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	names := make([]string, 0, len(m.values))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if help, ok := m.help[name]; ok {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, m.kinds[name])
+		}
+		keys := make([]string, 0, len(m.values[name]))
+		for key := range m.values[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if key == "" {
+				fmt.Fprintf(w, "%s %g\n", name, m.values[name][key])
+			} else {
+				fmt.Fprintf(w, "%s{%s} %g\n", name, key, m.values[name][key])
+			}
+		}
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Write(w)
+}
@@ -0,0 +1,45 @@
+package main
+
+import "fmt"
+
+// Mounts and unmounts the filesystems of volumes, so the driver logic does not depend on the
+// mount table of the server it runs on
+type Mounter interface {
+	// Mounts the device on the target directory, creating the directory when needed. The options
+	// are a comma separated list as accepted by mount(8), e.g. "noatime,discard".
+	Mount(device, target, fsType, options string) error
+	// Unmounts the filesystem mounted on the target directory
+	Unmount(target string) error
+	// Whether a filesystem is mounted on the target directory
+	IsMounted(target string) (bool, error)
+	// Returns the filesystems mounted below the given directory, as a map from mount point to device
+	Mounts(dir string) (map[string]string, error)
+}
+
+// Returned when unmounting a directory nothing is mounted on
+type NotMountedError struct {
+	Target string
+}
+
+func (e *NotMountedError) Error() string {
+	return fmt.Sprintf("Nothing is mounted on %s", e.Target)
+}
+
+// Returned when a filesystem is still in use and cannot be unmounted, or when the target of a
+// mount is already in use
+type BusyError struct {
+	Target string
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("%s is busy, it may still be in use by a process", e.Target)
+}
+
+// Returned when the device to mount does not exist
+type NoDeviceError struct {
+	Device string
+}
+
+func (e *NoDeviceError) Error() string {
+	return fmt.Sprintf("Device %s does not exist", e.Device)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// MS_LAZYTIME is missing from the syscall package
+const msLazytime = 1 << 25
+
+// Mount options that are passed to mount(2) as flags rather than as filesystem data
+var mountFlags = map[string]struct {
+	set   bool
+	flags uintptr
+}{
+	"defaults":    {true, 0},
+	"ro":          {true, syscall.MS_RDONLY},
+	"rw":          {false, syscall.MS_RDONLY},
+	"nosuid":      {true, syscall.MS_NOSUID},
+	"suid":        {false, syscall.MS_NOSUID},
+	"nodev":       {true, syscall.MS_NODEV},
+	"dev":         {false, syscall.MS_NODEV},
+	"noexec":      {true, syscall.MS_NOEXEC},
+	"exec":        {false, syscall.MS_NOEXEC},
+	"sync":        {true, syscall.MS_SYNCHRONOUS},
+	"async":       {false, syscall.MS_SYNCHRONOUS},
+	"dirsync":     {true, syscall.MS_DIRSYNC},
+	"noatime":     {true, syscall.MS_NOATIME},
+	"atime":       {false, syscall.MS_NOATIME},
+	"nodiratime":  {true, syscall.MS_NODIRATIME},
+	"diratime":    {false, syscall.MS_NODIRATIME},
+	"relatime":    {true, syscall.MS_RELATIME},
+	"norelatime":  {false, syscall.MS_RELATIME},
+	"strictatime": {true, syscall.MS_STRICTATIME},
+	"lazytime":    {true, msLazytime},
+	"nolazytime":  {false, msLazytime},
+	"mand":        {true, syscall.MS_MANDLOCK},
+	"nomand":      {false, syscall.MS_MANDLOCK},
+}
+
+// Mounts filesystems using the mount(2) and umount2(2) system calls
+type LinuxMounter struct{}
+
+func NewMounter() Mounter {
+	return LinuxMounter{}
+}
+
+// Splits mount options into the flags of mount(2) and the options passed on to the filesystem
+func parseMountOptions(options string) (uintptr, string) {
+	var flags uintptr
+	var data []string
+	for _, option := range strings.Split(options, ",") {
+		if option == "" {
+			continue
+		}
+		if f, ok := mountFlags[option]; ok {
+			if f.set {
+				flags |= f.flags
+			} else {
+				flags &^= f.flags
+			}
+		} else {
+			data = append(data, option)
+		}
+	}
+	return flags, strings.Join(data, ",")
+}
+
+func (m LinuxMounter) Mount(device, target, fsType, options string) error {
+	log.Debugf("Mounting %s on %s (type %s, options %q)", device, target, fsType, options)
+	if fsType == "" {
+		return fmt.Errorf("Cannot mount %s without knowing its filesystem type", device)
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("Failed to create mount point %s: %s", target, err)
+	}
+	flags, data := parseMountOptions(options)
+	err := syscall.Mount(device, target, fsType, flags, data)
+	switch err {
+	case nil:
+		return nil
+	case syscall.EBUSY:
+		return &BusyError{Target: target}
+	case syscall.ENOENT, syscall.ENXIO:
+		if _, statErr := os.Stat(device); os.IsNotExist(statErr) || err == syscall.ENXIO {
+			return &NoDeviceError{Device: device}
+		}
+	case syscall.ENODEV:
+		return fmt.Errorf("Failed to mount %s on %s: the kernel does not support %s filesystems", device, target, fsType)
+	case syscall.EINVAL:
+		return fmt.Errorf("Failed to mount %s on %s: wrong filesystem type, bad superblock or invalid options %q", device, target, options)
+	}
+	return fmt.Errorf("Failed to mount %s on %s: %s", device, target, err)
+}
+
+func (m LinuxMounter) Unmount(target string) error {
+	log.Debugf("Unmounting %s", target)
+	err := syscall.Unmount(target, 0)
+	switch err {
+	case nil:
+		return nil
+	case syscall.EINVAL, syscall.ENOENT:
+		// EINVAL means the target is not a mount point
+		return &NotMountedError{Target: target}
+	case syscall.EBUSY:
+		return &BusyError{Target: target}
+	}
+	return fmt.Errorf("Failed to unmount %s: %s", target, err)
+}
+
+func (m LinuxMounter) IsMounted(target string) (bool, error) {
+	target = filepath.Clean(target)
+	mounts, err := getMounts(target)
+	if err != nil {
+		return false, err
+	}
+	_, ok := mounts[target]
+	return ok, nil
+}
+
+func (m LinuxMounter) Mounts(dir string) (map[string]string, error) {
+	return getMounts(filepath.Clean(dir))
+}
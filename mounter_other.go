@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+var errMountUnsupported = errors.New("Volumes can only be mounted on Linux")
+
+// Mounter for platforms the plugin cannot mount volumes on, so the command line tools still build
+type unsupportedMounter struct{}
+
+func NewMounter() Mounter {
+	return unsupportedMounter{}
+}
+
+func (m unsupportedMounter) Mount(device, target, fsType, options string) error {
+	return errMountUnsupported
+}
+
+func (m unsupportedMounter) Unmount(target string) error {
+	return errMountUnsupported
+}
+
+func (m unsupportedMounter) IsMounted(target string) (bool, error) {
+	return false, errMountUnsupported
+}
+
+func (m unsupportedMounter) Mounts(dir string) (map[string]string, error) {
+	return nil, errMountUnsupported
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Settings of the OpenStack backend, the same as in the OpenStack RC file of the project
+type OpenStackConfig struct {
+	AuthURL           string // Keystone v3 endpoint, e.g. https://auth.cloud.ovh.net/v3
+	Username          string
+	Password          string
+	ProjectId         string // either the id or the name of the project is required
+	ProjectName       string
+	UserDomainName    string // "Default" when empty
+	ProjectDomainName string // "Default" when empty
+	Region            string // DefaultRegion when empty
+}
+
+// Volume backend using the OpenStack APIs: Keystone to authenticate, Cinder for volumes and
+// snapshots and Nova for attachments and instances
+type OpenStackClient struct {
+	conf *Config
+	http *http.Client
+
+	mutex      *sync.Mutex
+	token      string
+	expires    time.Time
+	volumeURL  string
+	computeURL string
+	// whether the block storage API supports microversions, needed to extend attached volumes
+	microversions bool
+}
+
+// Returned for API requests failing with an HTTP error status
+type OpenStackError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *OpenStackError) Error() string {
+	return fmt.Sprintf("OpenStack API error (HTTP %d): %s", e.StatusCode, e.Message)
+}
+
+// Checks that the settings needed to authenticate are present
+func (c OpenStackConfig) validate() error {
+	switch {
+	case c.AuthURL == "":
+		return errors.New("Set the OpenStack AuthURL to use the OpenStack backend")
+	case c.Username == "" || c.Password == "":
+		return errors.New("Set the OpenStack Username and Password to use the OpenStack backend")
+	case c.ProjectId == "" && c.ProjectName == "":
+		return errors.New("Set the OpenStack ProjectId or ProjectName to use the OpenStack backend")
+	}
+	return nil
+}
+
+func NewOpenStackClient(conf *Config) *OpenStackClient {
+	return &OpenStackClient{
+		conf:  conf,
+		http:  &http.Client{Timeout: 60 * time.Second},
+		mutex: &sync.Mutex{},
+	}
+}
+
+type keystoneCatalogEntry struct {
+	Type      string `json:"type"`
+	Endpoints []struct {
+		Interface string `json:"interface"`
+		Region    string `json:"region"`
+		URL       string `json:"url"`
+	} `json:"endpoints"`
+}
+
+// Requests a new token from Keystone and looks up the endpoints of the region in its catalog
+func (c *OpenStackClient) authenticate(ctx context.Context) error {
+	settings := c.conf.OpenStack
+	userDomain, projectDomain := settings.UserDomainName, settings.ProjectDomainName
+	if userDomain == "" {
+		userDomain = "Default"
+	}
+	if projectDomain == "" {
+		projectDomain = "Default"
+	}
+	project := map[string]interface{}{"id": settings.ProjectId}
+	if settings.ProjectId == "" {
+		project = map[string]interface{}{"name": settings.ProjectName, "domain": map[string]string{"name": projectDomain}}
+	}
+	auth := map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": map[string]interface{}{
+				"methods": []string{"password"},
+				"password": map[string]interface{}{
+					"user": map[string]interface{}{
+						"name":     settings.Username,
+						"password": settings.Password,
+						"domain":   map[string]string{"name": userDomain},
+					},
+				},
+			},
+			"scope": map[string]interface{}{"project": project},
+		},
+	}
+	body, err := json.Marshal(auth)
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(settings.AuthURL, "/") + "/auth/tokens"
+	log.Debugf("Authenticating as %s on %s", settings.Username, url)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("Could not reach Keystone at %s: %s", url, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		osErr := readOpenStackError(res)
+		osErr.Message = "Keystone authentication failed: " + osErr.Message
+		return osErr
+	}
+
+	var token struct {
+		Token struct {
+			ExpiresAt time.Time              `json:"expires_at"`
+			Catalog   []keystoneCatalogEntry `json:"catalog"`
+		} `json:"token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return fmt.Errorf("Invalid Keystone response: %s", err)
+	}
+
+	c.volumeURL, c.microversions = "", false
+	for _, serviceType := range []string{"volumev3", "volumev2"} {
+		if url := endpointURL(token.Token.Catalog, serviceType, settings.Region); url != "" {
+			c.volumeURL, c.microversions = url, serviceType == "volumev3"
+			break
+		}
+	}
+	c.computeURL = endpointURL(token.Token.Catalog, "compute", settings.Region)
+	if c.volumeURL == "" || c.computeURL == "" {
+		return fmt.Errorf("The block storage and compute APIs were not found in region %s", settings.Region)
+	}
+	c.token = res.Header.Get("X-Subject-Token")
+	c.expires = token.Token.ExpiresAt
+	log.Debugf("Authenticated until %s, using %s and %s", c.expires, c.volumeURL, c.computeURL)
+	return nil
+}
+
+// Returns the public endpoint of a service in the region
+func endpointURL(catalog []keystoneCatalogEntry, serviceType, region string) string {
+	for _, entry := range catalog {
+		if entry.Type != serviceType {
+			continue
+		}
+		for _, endpoint := range entry.Endpoints {
+			if endpoint.Interface == "public" && (region == "" || endpoint.Region == region) {
+				return strings.TrimSuffix(endpoint.URL, "/")
+			}
+		}
+	}
+	return ""
+}
+
+// Returns the message of an OpenStack error response, e.g. {"itemNotFound": {"message": "..."}}
+func readOpenStackError(res *http.Response) *OpenStackError {
+	body, _ := ioutil.ReadAll(res.Body)
+	var wrapped map[string]struct {
+		Message string `json:"message"`
+	}
+	message := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &wrapped) == nil {
+		for _, inner := range wrapped {
+			if inner.Message != "" {
+				message = inner.Message
+			}
+		}
+	}
+	return &OpenStackError{StatusCode: res.StatusCode, Message: message}
+}
+
+const (
+	volumeService  = "volume"
+	computeService = "compute"
+)
+
+// Sends a request to the block storage or compute API, authenticating first when needed
+func (c *OpenStackClient) request(ctx context.Context, service, method, path string, body, result interface{}) error {
+	return c.requestVersion(ctx, service, "", method, path, body, result)
+}
+
+// Sends a request using the given microversion of the block storage API, if it supports those
+func (c *OpenStackClient) requestVersion(ctx context.Context, service, microversion, method, path string, body, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		c.mutex.Lock()
+		if c.token == "" || time.Now().Add(time.Minute).After(c.expires) {
+			if err := c.authenticate(ctx); err != nil {
+				c.mutex.Unlock()
+				return err
+			}
+		}
+		token, base, microversions := c.token, c.computeURL, c.microversions
+		if service == volumeService {
+			base = c.volumeURL
+		}
+		c.mutex.Unlock()
+
+		req, err := http.NewRequest(method, base+path, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Auth-Token", token)
+		req.Header.Set("Accept", "application/json")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if service == volumeService && microversions && microversion != "" {
+			req.Header.Set("OpenStack-API-Version", "volume "+microversion)
+		}
+		log.Debugf("Sending %s to %s", method, req.URL)
+		res, err := c.http.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+
+		// the token may have been revoked, authenticate again once
+		if res.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			res.Body.Close()
+			c.mutex.Lock()
+			c.token = ""
+			c.mutex.Unlock()
+			continue
+		}
+		defer res.Body.Close()
+		if res.StatusCode >= 400 {
+			return readOpenStackError(res)
+		}
+		if result == nil || res.StatusCode == http.StatusNoContent {
+			return nil
+		}
+		return json.NewDecoder(res.Body).Decode(result)
+	}
+}
+
+type cinderVolume struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Status      string `json:"status"`
+	Size        int    `json:"size"`
+	VolumeType  string `json:"volume_type"`
+	CreatedAt   string `json:"created_at"`
+	Bootable    string `json:"bootable"`
+	Attachments []struct {
+		ServerId string `json:"server_id"`
+	} `json:"attachments"`
+}
+
+func (c *OpenStackClient) toVolume(v cinderVolume) Volume {
+	vol := Volume{
+		Id:           v.Id,
+		Name:         v.Name,
+		Description:  v.Description,
+		Status:       v.Status,
+		Region:       c.conf.OpenStack.Region,
+		Type:         v.VolumeType,
+		Size:         v.Size,
+		CreationDate: openStackTime(v.CreatedAt),
+		Bootable:     v.Bootable == "true",
+		AttachedTo:   []string{},
+	}
+	for _, attachment := range v.Attachments {
+		vol.AttachedTo = append(vol.AttachedTo, attachment.ServerId)
+	}
+	return vol
+}
+
+type cinderSnapshot struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	VolumeId    string `json:"volume_id"`
+	Size        int    `json:"size"`
+	Status      string `json:"status"`
+	CreatedAt   string `json:"created_at"`
+}
+
+func (c *OpenStackClient) toSnapshot(s cinderSnapshot) Snapshot {
+	return Snapshot{
+		Id:           s.Id,
+		Name:         s.Name,
+		Description:  s.Description,
+		VolumeId:     s.VolumeId,
+		Region:       c.conf.OpenStack.Region,
+		Size:         s.Size,
+		Status:       s.Status,
+		CreationDate: openStackTime(s.CreatedAt),
+	}
+}
+
+// Converts the timestamps of OpenStack, in UTC without a zone, to RFC 3339 like the OVH API uses
+func openStackTime(s string) string {
+	t, err := time.Parse("2006-01-02T15:04:05.999999", s)
+	if err != nil {
+		return s
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (c *OpenStackClient) ListVolumes(ctx context.Context) ([]Volume, error) {
+	var res struct {
+		Volumes []cinderVolume `json:"volumes"`
+	}
+	err := c.call(ctx, "list volumes", true, func() error {
+		return c.request(ctx, volumeService, "GET", "/volumes/detail", nil, &res)
+	})
+	if err != nil {
+		return nil, err
+	}
+	volumes := []Volume{}
+	for _, v := range res.Volumes {
+		volumes = append(volumes, c.toVolume(v))
+	}
+	return volumes, nil
+}
+
+func (c *OpenStackClient) GetVolume(ctx context.Context, volumeId string) (Volume, error) {
+	var res struct {
+		Volume cinderVolume `json:"volume"`
+	}
+	err := c.call(ctx, "retrieve volume "+volumeId, true, func() error {
+		return c.request(ctx, volumeService, "GET", "/volumes/"+volumeId, nil, &res)
+	})
+	if apiErrorKind(err) == API_ERROR_NOT_FOUND {
+		return Volume{}, nil
+	} else if err != nil {
+		return Volume{}, err
+	}
+	return c.toVolume(res.Volume), nil
+}
+
+func (c *OpenStackClient) CreateVolume(ctx context.Context, options VolumePost) (Volume, error) {
+	volume := map[string]interface{}{
+		"size":        options.Size,
+		"name":        options.Name,
+		"description": options.Description,
+		"volume_type": options.Type,
+	}
+	if options.SnapshotId != "" {
+		volume["snapshot_id"] = options.SnapshotId
+	}
+	if options.ImageId != "" {
+		volume["imageRef"] = options.ImageId
+	}
+	var res struct {
+		Volume cinderVolume `json:"volume"`
+	}
+	err := c.call(ctx, "create volume "+options.Name, false, func() error {
+		return c.request(ctx, volumeService, "POST", "/volumes", map[string]interface{}{"volume": volume}, &res)
+	})
+	if err != nil {
+		return Volume{}, err
+	}
+	return c.toVolume(res.Volume), nil
+}
+
+func (c *OpenStackClient) UpdateVolume(ctx context.Context, volumeId string, update VolumePut) (Volume, error) {
+	body := map[string]interface{}{"volume": map[string]string{"name": update.Name, "description": update.Description}}
+	var res struct {
+		Volume cinderVolume `json:"volume"`
+	}
+	err := c.call(ctx, "update volume "+volumeId, true, func() error {
+		return c.request(ctx, volumeService, "PUT", "/volumes/"+volumeId, body, &res)
+	})
+	if err != nil {
+		return Volume{}, err
+	}
+	return c.toVolume(res.Volume), nil
+}
+
+func (c *OpenStackClient) DeleteVolume(ctx context.Context, volumeId string) error {
+	return c.call(ctx, "delete volume "+volumeId, false, func() error {
+		return c.request(ctx, volumeService, "DELETE", "/volumes/"+volumeId, nil, nil)
+	})
+}
+
+func (c *OpenStackClient) AttachVolume(ctx context.Context, volumeId string) (Volume, error) {
+	body := map[string]interface{}{"volumeAttachment": map[string]string{"volumeId": volumeId}}
+	path := fmt.Sprintf("/servers/%s/os-volume_attachments", c.conf.ServerId)
+	err := c.call(ctx, "attach volume "+volumeId, false, func() error {
+		return c.request(ctx, computeService, "POST", path, body, nil)
+	})
+	if err != nil {
+		return Volume{}, err
+	}
+	return c.GetVolume(ctx, volumeId)
+}
+
+func (c *OpenStackClient) DetachVolume(ctx context.Context, volumeId string) (Volume, error) {
+	path := fmt.Sprintf("/servers/%s/os-volume_attachments/%s", c.conf.ServerId, volumeId)
+	err := c.call(ctx, "detach volume "+volumeId, false, func() error {
+		return c.request(ctx, computeService, "DELETE", path, nil, nil)
+	})
+	if err != nil {
+		return Volume{}, err
+	}
+	return c.GetVolume(ctx, volumeId)
+}
+
+func (c *OpenStackClient) UpsizeVolume(ctx context.Context, volumeId string, size int) (Volume, error) {
+	body := map[string]interface{}{"os-extend": map[string]int{"new_size": size}}
+	// 3.42 allows extending volumes while they are attached
+	err := c.call(ctx, fmt.Sprintf("upsize volume %s to %d GB", volumeId, size), false, func() error {
+		return c.requestVersion(ctx, volumeService, "3.42", "POST", "/volumes/"+volumeId+"/action", body, nil)
+	})
+	if err != nil {
+		return Volume{}, err
+	}
+	return c.GetVolume(ctx, volumeId)
+}
+
+func (c *OpenStackClient) ListSnapshots(ctx context.Context) ([]Snapshot, error) {
+	var res struct {
+		Snapshots []cinderSnapshot `json:"snapshots"`
+	}
+	err := c.call(ctx, "list snapshots", true, func() error {
+		return c.request(ctx, volumeService, "GET", "/snapshots/detail", nil, &res)
+	})
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []Snapshot{}
+	for _, s := range res.Snapshots {
+		snapshots = append(snapshots, c.toSnapshot(s))
+	}
+	return snapshots, nil
+}
+
+func (c *OpenStackClient) GetSnapshot(ctx context.Context, snapshotId string) (Snapshot, error) {
+	var res struct {
+		Snapshot cinderSnapshot `json:"snapshot"`
+	}
+	err := c.call(ctx, "retrieve snapshot "+snapshotId, true, func() error {
+		return c.request(ctx, volumeService, "GET", "/snapshots/"+snapshotId, nil, &res)
+	})
+	if apiErrorKind(err) == API_ERROR_NOT_FOUND {
+		return Snapshot{}, nil
+	} else if err != nil {
+		return Snapshot{}, err
+	}
+	return c.toSnapshot(res.Snapshot), nil
+}
+
+func (c *OpenStackClient) CreateSnapshot(ctx context.Context, volumeId string, options SnapshotPost) (Snapshot, error) {
+	body := map[string]interface{}{"snapshot": map[string]interface{}{
+		"volume_id":   volumeId,
+		"name":        options.Name,
+		"description": options.Description,
+		// snapshots of attached volumes are allowed by the OVH API as well
+		"force": true,
+	}}
+	var res struct {
+		Snapshot cinderSnapshot `json:"snapshot"`
+	}
+	err := c.call(ctx, "create snapshot of volume "+volumeId, false, func() error {
+		return c.request(ctx, volumeService, "POST", "/snapshots", body, &res)
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return c.toSnapshot(res.Snapshot), nil
+}
+
+func (c *OpenStackClient) DeleteSnapshot(ctx context.Context, snapshotId string) error {
+	return c.call(ctx, "delete snapshot "+snapshotId, false, func() error {
+		return c.request(ctx, volumeService, "DELETE", "/snapshots/"+snapshotId, nil, nil)
+	})
+}
+
+func (c *OpenStackClient) ListInstances(ctx context.Context) ([]Instance, error) {
+	var res struct {
+		Servers []struct {
+			Id        string `json:"id"`
+			Name      string `json:"name"`
+			Status    string `json:"status"`
+			Created   string `json:"created"`
+			Addresses map[string][]struct {
+				Addr    string `json:"addr"`
+				Version int    `json:"version"`
+			} `json:"addresses"`
+		} `json:"servers"`
+	}
+	err := c.call(ctx, "list instances", true, func() error {
+		return c.request(ctx, computeService, "GET", "/servers/detail", nil, &res)
+	})
+	if err != nil {
+		return nil, err
+	}
+	instances := []Instance{}
+	for _, server := range res.Servers {
+		instance := Instance{
+			Id:      server.Id,
+			Name:    server.Name,
+			Status:  server.Status,
+			Created: server.Created,
+			Region:  c.conf.OpenStack.Region,
+		}
+		for network, addresses := range server.Addresses {
+			for _, address := range addresses {
+				instance.IpAddresses = append(instance.IpAddresses, InstanceIp{Ip: address.Addr, Version: address.Version, NetworkId: network})
+			}
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
@@ -1,23 +1,74 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"strings"
+	"sync"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/ovh/go-ovh/ovh"
 )
 
+// Volume backend using the OVH API. Failed calls are retried and classified, see retry.go.
 type OVHClient struct {
-	Client *ovh.Client
-	Conf   *Config
+	Conf *Config
+
+	mutex *sync.Mutex
+	api   *ovh.Client // holds the keys, including those found in the ovh.conf files
+}
+
+func NewOVHClient(conf *Config) (*OVHClient, error) {
+	api, err := ovh.NewClient(conf.OVHEndpoint, conf.ApplicationKey, conf.ApplicationSecret, conf.ConsumerKey)
+	if err != nil {
+		return nil, err
+	}
+	return &OVHClient{Conf: conf, mutex: &sync.Mutex{}, api: api}, nil
+}
+
+// Returns the client of the OVH API library
+func (oc *OVHClient) client() *ovh.Client {
+	oc.mutex.Lock()
+	defer oc.mutex.Unlock()
+	return oc.api
+}
+
+// Makes the next call determine the difference between the local clock and the OVH API again.
+// The library only does so once per client, so the client is replaced, keeping its keys.
+func (oc *OVHClient) resync() {
+	log.Info("OVH API rejected the request time, synchronising the clock with the API again")
+	oc.mutex.Lock()
+	defer oc.mutex.Unlock()
+	api, err := ovh.NewClient(oc.Conf.OVHEndpoint, oc.api.AppKey, oc.api.AppSecret, oc.api.ConsumerKey)
+	if err != nil {
+		log.Warningf("Could not create a new OVH API client: %s", err)
+		return
+	}
+	oc.api = api
+}
+
+// Sends a request to the OVH API, bound to the context. Error responses are returned as
+// *ovh.APIError.
+func (oc *OVHClient) send(ctx context.Context, method, path string, reqBody, result interface{}, signed bool) error {
+	err := oc.client().CallAPIWithContext(ctx, method, path, reqBody, result, signed)
+	if apiErr, ok := err.(*ovh.APIError); ok && len(apiErr.Message) > 200 {
+		// e.g. the HTML error page of a proxy
+		apiErr.Message = strings.TrimSpace(apiErr.Message[:200]) + "..."
+	}
+	return err
 }
 
 type Volume struct {
-	Id          string   `json:"id"`
-	Name        string   `json:"name"`
-	Description string   `json:"description"`
-	AttachedTo  []string `json:"attachedTo"`
-	Status      string   `json:"status"`
+	Id           string   `json:"id"`
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	AttachedTo   []string `json:"attachedTo"`
+	Status       string   `json:"status"`
+	Region       string   `json:"region"`
+	Type         string   `json:"type"`
+	Size         int      `json:"size"` // size in GBs
+	CreationDate string   `json:"creationDate"`
+	Bootable     bool     `json:"bootable"`
 }
 
 // POST data used to create a new volume
@@ -32,6 +83,34 @@ type VolumePost struct {
 	SnapshotId  string `json:"snapshotId"`
 }
 
+type Snapshot struct {
+	Id           string `json:"id"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	VolumeId     string `json:"volumeId"`
+	Region       string `json:"region"`
+	Size         int    `json:"size"` // size in GBs
+	Status       string `json:"status"`
+	CreationDate string `json:"creationDate"`
+}
+
+// POST data used to create a snapshot of a volume
+type SnapshotPost struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// PUT data used to change the name and description of a volume
+type VolumePut struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// POST data used to grow a volume
+type VolumeUpsizePost struct {
+	Size int `json:"size"` // new size in GBs
+}
+
 // POST data used for volume attaching & detaching
 type VolumeAttachmentPost struct {
 	InstanceId string `json:"instanceId"`
@@ -61,121 +140,127 @@ type InstanceIp struct {
 	Type      string `json:"type"`
 }
 
-func (oc OVHClient) ListVolumes() (volumes []Volume, error error) {
+func (oc *OVHClient) ListVolumes(ctx context.Context) (volumes []Volume, err error) {
 	volumes = []Volume{}
 	url := fmt.Sprintf("/cloud/project/%s/volume", oc.Conf.ProjectId)
 	log.Debugf("Retrieving %s", url)
-	if err := oc.Client.Get(url, &volumes); err != nil {
-		fmt.Printf("Error: %q", err)
-		return volumes, errors.New(fmt.Sprintf("Could not retrieve volumes: %s", err.Error()))
-	}
-
+	err = oc.call(ctx, "list volumes", true, func() error { return oc.send(ctx, "GET", url, nil, &volumes, true) })
 	return
 }
 
-func (oc OVHClient) GetVolumeByName(name string) (vol Volume, err error) {
-	vol = Volume{}
-	volumes, err := oc.ListVolumes()
-	if err != nil {
-		return vol, err
-	}
-
-	for _, element := range volumes {
-		if element.Name == name {
-			return element, nil
-		}
+// Retrieves a single volume by its id, returns an empty volume if it does not exist
+func (oc *OVHClient) GetVolume(ctx context.Context, volumeId string) (vol Volume, err error) {
+	url := fmt.Sprintf("/cloud/project/%s/volume/%s", oc.Conf.ProjectId, volumeId)
+	log.Debugf("Retrieving %s", url)
+	err = oc.call(ctx, "retrieve volume "+volumeId, true, func() error { return oc.send(ctx, "GET", url, nil, &vol, true) })
+	if apiErrorKind(err) == API_ERROR_NOT_FOUND {
+		return Volume{}, nil
 	}
-
-	return vol, nil
+	return
 }
 
-func (oc OVHClient) CreateVolume(createVolumeOptions VolumePost) (volume Volume, err error) {
-	log.Debugf("Creating volume with options: %+v", createVolumeOptions)
-
+func (oc *OVHClient) CreateVolume(ctx context.Context, createVolumeOptions VolumePost) (volume Volume, err error) {
 	createUrl := fmt.Sprintf("/cloud/project/%s/volume", oc.Conf.ProjectId)
 	log.Debugf("Sending POST to %s", createUrl)
-	volume = Volume{}
-	if err := oc.Client.Post(createUrl, createVolumeOptions, &volume); err != nil {
-		fmt.Printf("Error: %q\n", err)
-		return volume, errors.New(fmt.Sprintf("Error while creating volume %s, %s", createVolumeOptions.Name, err))
-	}
-
-	return volume, err
+	err = oc.call(ctx, "create volume "+createVolumeOptions.Name, false, func() error {
+		return oc.send(ctx, "POST", createUrl, createVolumeOptions, &volume, true)
+	})
+	return
 }
 
-func (oc OVHClient) DeleteVolume(volumeId string) error {
+func (oc *OVHClient) DeleteVolume(ctx context.Context, volumeId string) error {
 	deleteUrl := fmt.Sprintf("/cloud/project/%s/volume/%s", oc.Conf.ProjectId, volumeId)
-	deleteResponse := GenericApiResponse{}
 	log.Debugf("Sending DELETE to %s", deleteUrl)
-	if err := oc.Client.Delete(deleteUrl, &deleteResponse); err != nil {
-		log.Errorf("Failed to delete volume %s: %s. %s", volumeId, err.Error(), deleteResponse)
-		return errors.New(fmt.Sprintf("Failed to delete %s: %s", volumeId, err.Error()))
-	}
-	log.Debugf("Response from Delete: %+v\n", deleteResponse)
-
-	return nil
+	return oc.call(ctx, "delete volume "+volumeId, false, func() error { return oc.send(ctx, "DELETE", deleteUrl, nil, nil, true) })
 }
 
-func (oc OVHClient) AttachVolume(volumeId string) (volume Volume, err error) {
-	//volume = Volume{}
+func (oc *OVHClient) AttachVolume(ctx context.Context, volumeId string) (volume Volume, err error) {
 	attachRequest := VolumeAttachmentPost{
 		InstanceId: oc.Conf.ServerId,
 	}
 	attachUrl := fmt.Sprintf("/cloud/project/%s/volume/%s/attach", oc.Conf.ProjectId, volumeId)
 	log.Debugf("Sending POST to %s", attachUrl)
-	if err = oc.Client.Post(attachUrl, attachRequest, &volume); err != nil {
-		fmt.Printf("Error: %q\n", err)
-		return
-	}
-	log.Debugf("Received attach response: %s", volume)
-
+	err = oc.call(ctx, "attach volume "+volumeId, false, func() error {
+		return oc.send(ctx, "POST", attachUrl, attachRequest, &volume, true)
+	})
+	log.Debugf("Received attach response: %+v", volume)
 	return
 }
 
-func (oc OVHClient) DetachVolume(volumeId string) (volume Volume, err error) {
+func (oc *OVHClient) DetachVolume(ctx context.Context, volumeId string) (volume Volume, err error) {
 	detachRequest := VolumeAttachmentPost{
 		InstanceId: oc.Conf.ServerId,
 	}
 	detachUrl := fmt.Sprintf("/cloud/project/%s/volume/%s/detach", oc.Conf.ProjectId, volumeId)
 	log.Debugf("Sending POST to %s", detachUrl)
-	if err = oc.Client.Post(detachUrl, detachRequest, &volume); err != nil {
-		fmt.Printf("Error: %q\n", err)
-		return
-	}
-	log.Debugf("Received detach response: %s", volume)
+	err = oc.call(ctx, "detach volume "+volumeId, false, func() error {
+		return oc.send(ctx, "POST", detachUrl, detachRequest, &volume, true)
+	})
+	log.Debugf("Received detach response: %+v", volume)
+	return
+}
 
+// Changes the name and description of a volume
+func (oc *OVHClient) UpdateVolume(ctx context.Context, volumeId string, update VolumePut) (volume Volume, err error) {
+	updateUrl := fmt.Sprintf("/cloud/project/%s/volume/%s", oc.Conf.ProjectId, volumeId)
+	log.Debugf("Sending PUT to %s: %+v", updateUrl, update)
+	err = oc.call(ctx, "update volume "+volumeId, true, func() error { return oc.send(ctx, "PUT", updateUrl, update, &volume, true) })
 	return
 }
 
-func (oc OVHClient) ListInstances() (instances []Instance, error error) {
-	url := fmt.Sprintf("/cloud/project/%s/instance", oc.Conf.ProjectId)
-	log.Debugf("GET for %s", url)
-	if err := oc.Client.Get(url, &instances); err != nil {
-		fmt.Printf("Error: %q", err)
-		return instances, errors.New(fmt.Sprintf("Could not retrieve instances: %s", err.Error()))
-	}
+// Grows a volume to the given size
+func (oc *OVHClient) UpsizeVolume(ctx context.Context, volumeId string, size int) (volume Volume, err error) {
+	upsizeUrl := fmt.Sprintf("/cloud/project/%s/volume/%s/upsize", oc.Conf.ProjectId, volumeId)
+	log.Debugf("Sending POST to %s", upsizeUrl)
+	err = oc.call(ctx, fmt.Sprintf("upsize volume %s to %d GB", volumeId, size), false, func() error {
+		return oc.send(ctx, "POST", upsizeUrl, VolumeUpsizePost{Size: size}, &volume, true)
+	})
+	log.Debugf("Received upsize response: %+v", volume)
+	return
+}
 
+func (oc *OVHClient) ListSnapshots(ctx context.Context) (snapshots []Snapshot, err error) {
+	snapshots = []Snapshot{}
+	url := fmt.Sprintf("/cloud/project/%s/volume/snapshot", oc.Conf.ProjectId)
+	log.Debugf("Retrieving %s", url)
+	err = oc.call(ctx, "list snapshots", true, func() error { return oc.send(ctx, "GET", url, nil, &snapshots, true) })
 	return
 }
 
-func (oc OVHClient) GetInstanceByIps(ips []string) (instance Instance, error error) {
-	instances, err := oc.ListInstances()
-	if err != nil {
-		log.Errorf("Could not get instances: %s", err)
-		return instance, err
-	}
-	// loop over all instances, ip addresses and see if there's any overlap
-	for _, i := range instances {
-		log.Debugf("Checking instance %s's ips against %s", i.Name, ips)
-		for _, ipAddress := range i.IpAddresses {
-			if contains(ips, ipAddress.Ip) {
-				return i, nil
-			}
-		}
+// Retrieves a single snapshot by its id, returns an empty snapshot if it does not exist
+func (oc *OVHClient) GetSnapshot(ctx context.Context, snapshotId string) (snapshot Snapshot, err error) {
+	url := fmt.Sprintf("/cloud/project/%s/volume/snapshot/%s", oc.Conf.ProjectId, snapshotId)
+	log.Debugf("Retrieving %s", url)
+	err = oc.call(ctx, "retrieve snapshot "+snapshotId, true, func() error { return oc.send(ctx, "GET", url, nil, &snapshot, true) })
+	if apiErrorKind(err) == API_ERROR_NOT_FOUND {
+		return Snapshot{}, nil
 	}
 	return
 }
 
+func (oc *OVHClient) CreateSnapshot(ctx context.Context, volumeId string, snapshotOptions SnapshotPost) (snapshot Snapshot, err error) {
+	createUrl := fmt.Sprintf("/cloud/project/%s/volume/%s/snapshot", oc.Conf.ProjectId, volumeId)
+	log.Debugf("Sending POST to %s", createUrl)
+	err = oc.call(ctx, "snapshot volume "+volumeId, false, func() error {
+		return oc.send(ctx, "POST", createUrl, snapshotOptions, &snapshot, true)
+	})
+	log.Debugf("Received snapshot response: %+v", snapshot)
+	return
+}
+
+func (oc *OVHClient) DeleteSnapshot(ctx context.Context, snapshotId string) error {
+	deleteUrl := fmt.Sprintf("/cloud/project/%s/volume/snapshot/%s", oc.Conf.ProjectId, snapshotId)
+	log.Debugf("Sending DELETE to %s", deleteUrl)
+	return oc.call(ctx, "delete snapshot "+snapshotId, false, func() error { return oc.send(ctx, "DELETE", deleteUrl, nil, nil, true) })
+}
+
+func (oc *OVHClient) ListInstances(ctx context.Context) (instances []Instance, err error) {
+	url := fmt.Sprintf("/cloud/project/%s/instance", oc.Conf.ProjectId)
+	log.Debugf("GET for %s", url)
+	err = oc.call(ctx, "list instances", true, func() error { return oc.send(ctx, "GET", url, nil, &instances, true) })
+	return
+}
+
 // checks if s contains e
 func contains(xs []string, e string) bool {
 	for _, x := range xs {
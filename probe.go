@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Filesystems the plugin is able to mount
+var supportedFilesystems = []string{"ext2", "ext3", "ext4", "xfs", "btrfs"}
+
+// Result of probing a block device for existing data signatures
+type DeviceProbe struct {
+	Device         string
+	Blank          bool   // no signatures or partitions found at all
+	FSType         string // TYPE reported by blkid, e.g. ext4, crypto_LUKS or LVM2_member
+	Usage          string // USAGE reported by blkid, e.g. filesystem, crypto or raid
+	PartitionTable string // PTTYPE reported by blkid, e.g. gpt or dos
+	Partitions     []string
+}
+
+// Whether the device holds a filesystem the plugin can mount directly
+func (p DeviceProbe) IsMountable() bool {
+	return len(p.Partitions) == 0 && p.PartitionTable == "" && contains(supportedFilesystems, p.FSType)
+}
+
+// Human readable description of what was found on the device
+func (p DeviceProbe) Describe() string {
+	switch {
+	case p.Blank:
+		return "no data signatures"
+	case len(p.Partitions) > 0 || p.PartitionTable != "":
+		return fmt.Sprintf("a partition table (%s, partitions: %s)", p.PartitionTable, strings.Join(p.Partitions, ", "))
+	case p.FSType == "crypto_LUKS":
+		return "a LUKS encrypted volume"
+	case p.FSType == "LVM2_member":
+		return "an LVM physical volume"
+	case p.Usage == "filesystem":
+		return fmt.Sprintf("an unsupported %s filesystem", p.FSType)
+	default:
+		return fmt.Sprintf("an unknown signature (type %q, usage %q)", p.FSType, p.Usage)
+	}
+}
+
+// Probes the device for filesystem, partition table and other signatures. Only returns a result
+// with Blank set if blkid positively reported that nothing was found, every other failure is
+// returned as an error so a device is never mistaken for an empty one.
+func probeDevice(ctx context.Context, device string) (DeviceProbe, error) {
+	log.Debugf("Begin probeDevice: %s", device)
+	probe := DeviceProbe{Device: device}
+
+	partitions, err := devicePartitions(device)
+	if err != nil {
+		return probe, fmt.Errorf("Could not list partitions of %s: %s", device, err)
+	}
+	probe.Partitions = partitions
+
+	// -p bypasses the blkid cache and probes the device itself
+	out, err := exec.CommandContext(ctx, "blkid", "-p", "-o", "export", device).CombinedOutput()
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		// blkid exits with 2 when it did not find any signature
+		if ok && exitErr.Sys().(syscall.WaitStatus).ExitStatus() == 2 {
+			probe.Blank = len(partitions) == 0
+			return probe, nil
+		}
+		return probe, fmt.Errorf("blkid failed on %s: %s (%s)", device, err, strings.TrimSpace(string(out)))
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "TYPE":
+			probe.FSType = parts[1]
+		case "USAGE":
+			probe.Usage = parts[1]
+		case "PTTYPE":
+			probe.PartitionTable = parts[1]
+		}
+	}
+	if probe.FSType == "" && probe.PartitionTable == "" && probe.Usage == "" {
+		return probe, fmt.Errorf("blkid reported a signature on %s but no type: %s", device, strings.TrimSpace(string(out)))
+	}
+	return probe, nil
+}
+
+// Lists the partitions of a block device using sysfs
+func devicePartitions(device string) ([]string, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(resolved)
+	entries, err := ioutil.ReadDir(filepath.Join("/sys/class/block", name))
+	if err != nil {
+		return nil, err
+	}
+	var partitions []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), name) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join("/sys/class/block", name, entry.Name(), "partition")); err == nil {
+			partitions = append(partitions, entry.Name())
+		}
+	}
+	return partitions, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const BOOT_ID_FILE = "boot_id"
+
+// Outcome of a reconciliation pass, one line per volume that needed attention
+type ReconcileReport struct {
+	Remounted []string
+	Adopted   []string
+	Detached  []string
+	Cleared   []string
+	Removed   []string
+	Problems  []string
+}
+
+func (r *ReconcileReport) log() {
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"Remounted volumes", r.Remounted},
+		{"Adopted mounts", r.Adopted},
+		{"Detached unused volumes", r.Detached},
+		{"Cleared stale state", r.Cleared},
+		{"Removed mount directories", r.Removed},
+	}
+	for _, section := range sections {
+		for _, line := range section.lines {
+			log.Infof("Reconcile: %s: %s", section.title, line)
+		}
+	}
+	for _, line := range r.Problems {
+		log.Warningf("Reconcile: Inconsistency: %s", line)
+	}
+	log.Infof("Reconcile finished: %d remounted, %d adopted, %d detached, %d cleared, %d directories removed, %d inconsistencies",
+		len(r.Remounted), len(r.Adopted), len(r.Detached), len(r.Cleared), len(r.Removed), len(r.Problems))
+}
+
+// Rebuilds the local state from the volumes OVH reports as attached to this server, the kernel
+// mounts below the mount point and the mount directories, so a reboot or crash of the plugin
+// never leaves volumes attached without being mounted. It runs before the plugin serves any
+// requests, so it takes no volume locks.
+func (d OVHPlugin) reconcile(ctx context.Context) (*ReconcileReport, error) {
+	report := &ReconcileReport{}
+	volumes, err := d.Client.ListVolumes(ctx)
+	if err != nil {
+		return report, err
+	}
+	mounts, err := d.Mounter.Mounts(d.Conf.MountPoint)
+	if err != nil {
+		return report, fmt.Errorf("Could not read the mount table: %s", err)
+	}
+
+	// no mount survives a reboot, so the mounts recorded before it are gone
+	bootIdPath := filepath.Join(d.Conf.StateDir, BOOT_ID_FILE)
+	bootId := getBootId()
+	previousBootId, _ := ioutil.ReadFile(bootIdPath)
+	rebooted := len(previousBootId) > 0 && strings.TrimSpace(string(previousBootId)) != bootId
+	if rebooted {
+		log.Info("Server was restarted since the plugin last ran, clearing recorded mounts")
+	}
+
+	existing := map[string]bool{}
+	attached := map[string]Volume{}
+	for _, vol := range volumes {
+		existing[vol.Name] = true
+		if contains(vol.AttachedTo, d.Conf.ServerId) {
+			attached[vol.Name] = vol
+		}
+	}
+
+	// volumes this server used according to the local state
+	for _, name := range d.State.Names() {
+		vs, _ := d.State.Get(name)
+		_, isAttached := attached[name]
+		if rebooted && len(vs.MountIDs) > 0 {
+			if err := d.State.Update(name, func(vs *VolumeState) { vs.MountIDs = nil }); err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("The mounts of %s from before the restart could not be cleared from the state: %s", name, err))
+			}
+			vs.MountIDs = nil
+		}
+		if !existing[name] {
+			if err := d.State.Delete(name); err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s no longer exists on OVH, but could not be removed from the state: %s", name, err))
+			} else {
+				report.Cleared = append(report.Cleared, fmt.Sprintf("%s no longer exists on OVH", name))
+			}
+		} else if !isAttached && (vs.Mounted || vs.Device != "" || len(vs.MountIDs) > 0) {
+			err := d.State.Update(name, func(vs *VolumeState) {
+				vs.Mounted = false
+				vs.Device = ""
+				vs.Mapping = ""
+				vs.MountIDs = nil
+			})
+			if err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s is not attached to this server, but its state could not be cleared: %s", name, err))
+			} else {
+				report.Cleared = append(report.Cleared, fmt.Sprintf("%s is not attached to this server", name))
+			}
+		}
+	}
+
+	for name, vol := range attached {
+		path := d.mountPath(name)
+		device, isMounted := mounts[path]
+		vs, known := d.State.Get(name)
+		// only volumes this plugin attached itself have a device recorded
+		managed := known && (vs.Device != "" || vs.Mounted)
+
+		switch {
+		case isMounted:
+			err := d.State.Update(name, func(vs *VolumeState) {
+				vs.Id = vol.Id
+				vs.Region = vol.Region
+				vs.Mounted = true
+				vs.Device = device
+			})
+			if err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s is mounted from %s, but this could not be recorded in the state: %s", name, device, err))
+				continue
+			}
+			if len(vs.MountIDs) == 0 {
+				report.Adopted = append(report.Adopted, fmt.Sprintf("%s is mounted from %s without known containers", name, device))
+			}
+		case len(vs.MountIDs) > 0:
+			// containers still expect the volume to be mounted
+			device, err := NewDeviceResolver(d.Conf.Backend == BACKEND_SIMULATOR).Resolve(ctx, vol, 5*time.Second)
+			if err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s is attached and used by %d container(s), but its device could not be found: %s", name, len(vs.MountIDs), err))
+				continue
+			}
+			if isEncrypted(vol) {
+				if device, err = d.openEncrypted(ctx, name, vol, device); err != nil {
+					report.Problems = append(report.Problems, fmt.Sprintf("%s could not be remounted: %s", name, err))
+					continue
+				}
+			}
+			if err := d.checkBeforeMount(ctx, name, vol, device, vs.FSType); err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s could not be remounted from %s: %s", name, device, err))
+				continue
+			}
+			if err := d.Mounter.Mount(device, path, vs.FSType, d.Conf.filesystemOptions(vol).MountOpts); err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s could not be remounted from %s: %s", name, device, err))
+				continue
+			}
+			err = d.State.Update(name, func(vs *VolumeState) {
+				vs.Mounted = true
+				vs.Device = device
+			})
+			if err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s was remounted from %s, but this could not be recorded in the state: %s", name, device, err))
+				continue
+			}
+			report.Remounted = append(report.Remounted, fmt.Sprintf("%s from %s for %d container(s)", name, device, len(vs.MountIDs)))
+		case managed:
+			// attached by this plugin but no longer used, free it up for other servers
+			if err := d.Credentials.Allows(rightDetachVolume); err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s is attached without being used, but it cannot be detached: %s", name, err))
+				continue
+			}
+			if err := d.closeEncrypted(name); err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s is attached without being used, but %s", name, err))
+				continue
+			}
+			if _, err := d.Client.DetachVolume(ctx, vol.Id); err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s is attached without being used, but detaching failed: %s", name, err))
+				continue
+			}
+			err := d.State.Update(name, func(vs *VolumeState) {
+				vs.Mounted = false
+				vs.Device = ""
+			})
+			if err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s was detached, but this could not be recorded in the state: %s", name, err))
+				continue
+			}
+			report.Detached = append(report.Detached, name)
+		default:
+			report.Problems = append(report.Problems, fmt.Sprintf("%s (%s) is attached to this server but was not attached by this plugin, leaving it alone", name, vol.Id))
+		}
+	}
+
+	for path, device := range mounts {
+		name, err := filepath.Rel(d.Conf.MountPoint, path)
+		if err != nil || strings.Contains(name, "/") {
+			continue
+		}
+		if _, ok := attached[name]; !ok {
+			report.Problems = append(report.Problems, fmt.Sprintf("%s is mounted from %s, but OVH does not report the volume as attached to this server", path, device))
+		}
+	}
+
+	// mount directories of volumes that no longer exist
+	entries, err := ioutil.ReadDir(d.Conf.MountPoint)
+	if err != nil {
+		report.Problems = append(report.Problems, fmt.Sprintf("Could not list %s: %s", d.Conf.MountPoint, err))
+	}
+	for _, entry := range entries {
+		path := d.mountPath(entry.Name())
+		if !entry.IsDir() || existing[entry.Name()] {
+			continue
+		}
+		if _, isMounted := mounts[path]; isMounted {
+			continue
+		}
+		// only removes empty directories, so data is never lost
+		if err := os.Remove(path); err != nil {
+			report.Problems = append(report.Problems, fmt.Sprintf("%s belongs to no volume but could not be removed: %s", path, err))
+		} else {
+			report.Removed = append(report.Removed, path)
+		}
+	}
+
+	if bootId != "" {
+		if err := ioutil.WriteFile(bootIdPath, []byte(bootId), 0600); err != nil {
+			log.Warningf("Could not store boot id in %s: %s", bootIdPath, err)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const GB = 1024 * 1024 * 1024
+
+// Grows a Docker volume to the given size in GBs. A filesystem mounted on this server is grown
+// online, without unmounting it from the containers using it. Otherwise it is grown the next time
+// the volume is mounted.
+func (d OVHPlugin) ResizeVolume(ctx context.Context, name string, size int) (Volume, error) {
+	if err := d.lock(ctx, name); err != nil {
+		return Volume{}, err
+	}
+	defer d.unlock(name)
+	return d.resizeVolume(ctx, name, size)
+}
+
+func (d OVHPlugin) resizeVolume(ctx context.Context, name string, size int) (Volume, error) {
+	vol, err := d.findVolume(ctx, name)
+	if err != nil {
+		return vol, err
+	}
+	if vol.Id == "" {
+		return vol, fmt.Errorf("Volume with name %s could not be found", name)
+	}
+	if size < vol.Size {
+		return vol, fmt.Errorf("Volume %s is %d GB, it can only grow and not shrink to %d GB", name, vol.Size, size)
+	}
+	if size == vol.Size {
+		// the filesystem may not have been grown along with the volume before
+		log.Infof("Volume %s already is %d GB", name, size)
+	} else if vol.Status != "available" && vol.Status != "in-use" {
+		return vol, fmt.Errorf("Volume %s cannot be resized while it is %s", name, vol.Status)
+	} else {
+		if err := d.Credentials.Allows(rightUpsizeVolume); err != nil {
+			return vol, err
+		}
+		log.Infof("Growing volume %s (%s) from %d GB to %d GB", name, vol.Id, vol.Size, size)
+		if vol, err = d.Client.UpsizeVolume(ctx, vol.Id, size); err != nil {
+			return vol, err
+		}
+	}
+
+	vs, _ := d.State.Get(name)
+	if !vs.Mounted || !contains(vol.AttachedTo, d.Conf.ServerId) {
+		log.Infof("Volume %s is not mounted on this server, its filesystem will be grown when it is mounted", name)
+		return vol, nil
+	}
+	if err := d.growMountedFilesystem(ctx, name, vol, vs, int64(size)*GB); err != nil {
+		return vol, fmt.Errorf("Volume %s was grown to %d GB, but growing its filesystem failed: %s", name, size, err)
+	}
+	return vol, nil
+}
+
+// Waits for the kernel to see the new size of the device and grows the filesystem on it
+func (d OVHPlugin) growMountedFilesystem(ctx context.Context, name string, vol Volume, vs VolumeState, size int64) error {
+	device := vs.Device
+	if vs.Mapping != "" {
+		var err error
+		if device, err = mappingBackingDevice(vs.Mapping); err != nil {
+			return err
+		}
+	}
+	if err := RescanDevice(device); err != nil {
+		return fmt.Errorf("Failed to rescan device %s: %s", device, err)
+	}
+	deadline := time.Now().Add(d.Conf.timeout(d.Conf.DeviceTimeout))
+	b := newBackoff(100*time.Millisecond, 2*time.Second)
+	for {
+		current, err := DeviceSize(device)
+		if err != nil {
+			return fmt.Errorf("Failed to read the size of device %s: %s", device, err)
+		}
+		if current >= size {
+			break
+		}
+		if !b.wait(ctx, deadline) {
+			if ctx.Err() != nil {
+				return fmt.Errorf("Gave up waiting for device %s to grow: %s", device, ctx.Err())
+			}
+			return fmt.Errorf("Device %s is still %d bytes after %d seconds, expected %d", device, current, d.Conf.DeviceTimeout, size)
+		}
+	}
+
+	if vs.Mapping != "" {
+		key, err := d.Conf.encryptionKey(keyId(vol), false)
+		if err != nil {
+			return err
+		}
+		log.Infof("Growing encrypted mapping %s of %s", vs.Mapping, name)
+		if err := LuksResize(ctx, vs.Mapping, key); err != nil {
+			return fmt.Errorf("Failed to grow encrypted mapping %s: %s", vs.Mapping, err)
+		}
+	}
+
+	log.Infof("Growing %s filesystem of %s on %s", vs.FSType, name, vs.Device)
+	return GrowFilesystem(ctx, vs.Device, d.mountPath(name), vs.FSType)
+}
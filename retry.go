@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ovh/go-ovh/ovh"
+)
+
+// Kinds of failed cloud API calls, telling whether retrying can help and what the user should do
+const (
+	API_ERROR_UNAVAILABLE  = "unavailable"  // 5xx status, network error or garbled response, retried
+	API_ERROR_RATE_LIMITED = "rate-limited" // 429 status, retried
+	API_ERROR_CLOCK_SKEW   = "clock-skew"   // request timestamp rejected, retried after syncing the clock
+	API_ERROR_CREDENTIALS  = "credentials"  // invalid or expired application or consumer key
+	API_ERROR_FORBIDDEN    = "forbidden"    // the consumer key lacks the rights for the call
+	API_ERROR_NOT_FOUND    = "not-found"
+	API_ERROR_QUOTA        = "quota" // the project quota does not allow the request
+	API_ERROR_INVALID      = "invalid"
+)
+
+// Failed OVH or OpenStack API call, after retrying if the failure was temporary
+type APICallError struct {
+	API        string // "OVH" or "OpenStack"
+	Kind       string
+	Operation  string // e.g. "create volume db"
+	StatusCode int    // 0 when no response was received
+	Message    string
+	QueryId    string
+	Attempts   int
+}
+
+func (e *APICallError) Error() string {
+	msg := fmt.Sprintf("Failed to %s: %s", e.Operation, e.Message)
+	if e.StatusCode != 0 {
+		msg = fmt.Sprintf("Failed to %s: %s API error %d: %s", e.Operation, e.API, e.StatusCode, e.Message)
+	}
+	if e.QueryId != "" {
+		msg += fmt.Sprintf(" (query id %s)", e.QueryId)
+	}
+	if e.Attempts > 1 {
+		msg += fmt.Sprintf(", gave up after %d attempts", e.Attempts)
+	}
+	return msg
+}
+
+// Whether retrying the call may succeed
+func (e *APICallError) Temporary() bool {
+	return e.Kind == API_ERROR_UNAVAILABLE || e.Kind == API_ERROR_RATE_LIMITED || e.Kind == API_ERROR_CLOCK_SKEW
+}
+
+// Returns the kind of an API call error, or an empty string for other errors
+func apiErrorKind(err error) string {
+	if e, ok := err.(*APICallError); ok {
+		return e.Kind
+	}
+	return ""
+}
+
+// Converts an error of the OVH client into an APICallError
+func classifyAPIError(operation string, err error) *APICallError {
+	apiErr, ok := err.(*ovh.APIError)
+	if !ok {
+		// the request did not get a proper answer, e.g. a connection error or an HTML error page
+		return &APICallError{API: "OVH", Kind: API_ERROR_UNAVAILABLE, Operation: operation, Message: err.Error()}
+	}
+
+	e := &APICallError{API: "OVH", Operation: operation, StatusCode: apiErr.Code, Message: apiErr.Message, QueryId: apiErr.QueryID}
+	message := strings.ToLower(apiErr.Message)
+	switch {
+	case apiErr.Code >= 500:
+		e.Kind = API_ERROR_UNAVAILABLE
+	case apiErr.Code == http.StatusTooManyRequests:
+		e.Kind = API_ERROR_RATE_LIMITED
+	case strings.Contains(message, "quota"):
+		e.Kind = API_ERROR_QUOTA
+	case apiErr.Code == http.StatusBadRequest && (strings.Contains(message, "out of time") || strings.Contains(message, "timestamp")):
+		e.Kind = API_ERROR_CLOCK_SKEW
+	case apiErr.Code == http.StatusUnauthorized:
+		e.Kind = API_ERROR_CREDENTIALS
+	case apiErr.Code == http.StatusForbidden && (strings.Contains(message, "credential") || strings.Contains(message, "application")):
+		e.Kind = API_ERROR_CREDENTIALS
+	case apiErr.Code == http.StatusForbidden:
+		e.Kind = API_ERROR_FORBIDDEN
+	case apiErr.Code == http.StatusNotFound:
+		e.Kind = API_ERROR_NOT_FOUND
+	default:
+		e.Kind = API_ERROR_INVALID
+	}
+	return e
+}
+
+// Converts an error of the OpenStack client into an APICallError
+func classifyOpenStackError(operation string, err error) *APICallError {
+	osErr, ok := err.(*OpenStackError)
+	if !ok {
+		// the request did not get a proper answer, e.g. a connection error
+		return &APICallError{API: "OpenStack", Kind: API_ERROR_UNAVAILABLE, Operation: operation, Message: err.Error()}
+	}
+
+	e := &APICallError{API: "OpenStack", Operation: operation, StatusCode: osErr.StatusCode, Message: osErr.Message}
+	switch {
+	case osErr.StatusCode >= 500:
+		e.Kind = API_ERROR_UNAVAILABLE
+	case osErr.StatusCode == http.StatusTooManyRequests:
+		e.Kind = API_ERROR_RATE_LIMITED
+	case strings.Contains(strings.ToLower(osErr.Message), "quota") || strings.Contains(osErr.Message, "LimitExceeded"):
+		e.Kind = API_ERROR_QUOTA
+	case osErr.StatusCode == http.StatusUnauthorized:
+		e.Kind = API_ERROR_CREDENTIALS
+	case osErr.StatusCode == http.StatusForbidden:
+		e.Kind = API_ERROR_FORBIDDEN
+	case osErr.StatusCode == http.StatusNotFound:
+		e.Kind = API_ERROR_NOT_FOUND
+	default:
+		e.Kind = API_ERROR_INVALID
+	}
+	return e
+}
+
+// Runs an OVH API call, see callAPI
+func (oc *OVHClient) call(ctx context.Context, operation string, idempotent bool, fn func() error) error {
+	return callAPI(ctx, oc.Conf, operation, idempotent, classifyAPIError, oc.resync, fn)
+}
+
+// Runs an OpenStack API call, see callAPI
+func (c *OpenStackClient) call(ctx context.Context, operation string, idempotent bool, fn func() error) error {
+	return callAPI(ctx, c.conf, operation, idempotent, classifyOpenStackError, nil, fn)
+}
+
+// Runs a cloud API call, retrying temporary failures with a jittered backoff until APIRetryTimeout
+// passed or the context is done. Calls that are not idempotent, such as creating a volume, are only
+// retried when the API certainly did not act on them: rate limiting, maintenance (503) and clock skew.
+// The errors of fn are converted by classify, resync is called after a clock skew error if set.
+func callAPI(ctx context.Context, conf *Config, operation string, idempotent bool, classify func(string, error) *APICallError, resync func(), fn func() error) error {
+	deadline := time.Now().Add(conf.timeout(conf.APIRetryTimeout))
+	b := newBackoff(time.Second, 15*time.Second)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("Failed to %s: %s", operation, ctx.Err())
+		}
+		e := classify(operation, err)
+		retry := e.Temporary() && (idempotent || e.Kind != API_ERROR_UNAVAILABLE || e.StatusCode == http.StatusServiceUnavailable)
+		remaining := deadline.Sub(time.Now())
+		if !retry || remaining <= 0 {
+			e.Attempts = attempt
+			return e
+		}
+		if e.Kind == API_ERROR_CLOCK_SKEW && resync != nil {
+			resync()
+		}
+
+		delay := b.nextJittered()
+		if delay > remaining {
+			delay = remaining
+		}
+		log.Warningf("%s, retrying in %s (attempt %d)", e, delay-delay%time.Millisecond, attempt)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			e.Attempts = attempt
+			return e
+		}
+	}
+}
+
+// Describes an error for the Docker user, adding what to do about the failures of API calls
+func errorMessage(err error) string {
+	e, ok := err.(*APICallError)
+	if !ok {
+		return err.Error()
+	}
+	switch {
+	case e.Kind == API_ERROR_CREDENTIALS && e.API == "OpenStack":
+		return fmt.Sprintf("%s. The OpenStack user could not authenticate, check the OpenStack settings in the plugin config", e)
+	case e.Kind == API_ERROR_FORBIDDEN && e.API == "OpenStack":
+		return fmt.Sprintf("%s. The OpenStack user is not allowed to make this call", e)
+	}
+	switch e.Kind {
+	case API_ERROR_UNAVAILABLE:
+		return fmt.Sprintf("%s. The %s API is unavailable, try again later", e, e.API)
+	case API_ERROR_RATE_LIMITED:
+		return fmt.Sprintf("%s. Too many requests were made to the %s API, try again later", e, e.API)
+	case API_ERROR_CLOCK_SKEW:
+		return fmt.Sprintf("%s. The clock of this server is off, make sure it is synchronised using NTP", e)
+	case API_ERROR_CREDENTIALS:
+		return fmt.Sprintf("%s. The OVH API keys are invalid or the consumer key expired, create a new consumer key and update ConsumerKey in the plugin config", e)
+	case API_ERROR_FORBIDDEN:
+		return fmt.Sprintf("%s. The consumer key is not allowed to make this call, create a consumer key with the rights listed in the README", e)
+	case API_ERROR_QUOTA:
+		return fmt.Sprintf("%s. The quota of the OVH project is exhausted, remove unused volumes and snapshots or ask OVH to raise the quota", e)
+	}
+	return e.Error()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Name prefix of the snapshots taken by the scheduler, only these are pruned
+const SCHEDULED_SNAPSHOT_PREFIX = "auto-"
+
+// Volume option keys of the snapshot policy
+const (
+	OPT_SNAPSHOT_SCHEDULE = "snapshot_schedule"
+	OPT_SNAPSHOT_KEEP     = "snapshot_keep"
+	OPT_SNAPSHOT_MAX_AGE  = "snapshot_max_age"
+	OPT_SNAPSHOT_FREEZE   = "snapshot_freeze"
+)
+
+// When to take snapshots of a volume and how long to keep them
+type SnapshotPolicy struct {
+	Schedule string // cron expression, e.g. "0 3 * * *", or "@every 6h"
+	Keep     int    // number of scheduled snapshots to keep, 0 for no limit
+	MaxAge   string // remove scheduled snapshots older than this, e.g. "14d", empty for no limit
+	Freeze   bool   // freeze the filesystem while the snapshot is taken
+}
+
+// Validates a snapshot policy volume option
+func validateSnapshotOption(key, value string) error {
+	var err error
+	switch key {
+	case OPT_SNAPSHOT_SCHEDULE:
+		_, err = parseSchedule(value)
+	case OPT_SNAPSHOT_KEEP:
+		var keep int
+		if keep, err = strconv.Atoi(value); err == nil && keep < 0 {
+			err = fmt.Errorf("%s must not be negative", key)
+		}
+	case OPT_SNAPSHOT_MAX_AGE:
+		_, err = parseDuration(value)
+	case OPT_SNAPSHOT_FREEZE:
+		_, err = strconv.ParseBool(value)
+	}
+	return err
+}
+
+// Returns the snapshot policy of a volume, the volume options take precedence over the policy
+// configured for the volume name in the config file
+func (c *Config) snapshotPolicy(vol Volume) SnapshotPolicy {
+	policy := c.SnapshotPolicies[vol.Name]
+	meta := decodeDescription(vol.Description)
+	if schedule, ok := meta[OPT_SNAPSHOT_SCHEDULE]; ok {
+		policy = SnapshotPolicy{Schedule: schedule, MaxAge: meta[OPT_SNAPSHOT_MAX_AGE]}
+		policy.Keep, _ = strconv.Atoi(meta[OPT_SNAPSHOT_KEEP])
+		policy.Freeze, _ = strconv.ParseBool(meta[OPT_SNAPSHOT_FREEZE])
+	}
+	return policy
+}
+
+type snapshotJob struct {
+	policy   SnapshotPolicy
+	schedule Schedule
+	next     time.Time
+}
+
+// Takes the scheduled snapshots of the volumes attached to this server and prunes old ones. Only
+// the server a volume is attached to snapshots it, so each snapshot is taken once.
+type SnapshotScheduler struct {
+	d    OVHPlugin
+	jobs map[string]*snapshotJob
+}
+
+func NewSnapshotScheduler(d OVHPlugin) *SnapshotScheduler {
+	d.Metrics.Describe("ovh_scheduled_snapshots_total", "counter", "Number of scheduled snapshots taken, by volume and result")
+	d.Metrics.Describe("ovh_scheduled_snapshot_last_success_timestamp_seconds", "gauge", "Time of the last successful scheduled snapshot, by volume")
+	d.Metrics.Describe("ovh_scheduled_snapshot_duration_seconds", "gauge", "Duration of the last scheduled snapshot, by volume")
+	d.Metrics.Describe("ovh_snapshots_pruned_total", "counter", "Number of scheduled snapshots removed by the retention policy, by volume and result")
+	return &SnapshotScheduler{d: d, jobs: map[string]*snapshotJob{}}
+}
+
+// Runs the scheduler, picking up changed policies every few minutes
+func (s *SnapshotScheduler) Run() {
+	s.refresh(time.Now())
+	refreshTicker := time.NewTicker(5 * time.Minute)
+	checkTicker := time.NewTicker(30 * time.Second)
+	for {
+		select {
+		case now := <-refreshTicker.C:
+			s.refresh(now)
+		case now := <-checkTicker.C:
+			s.runDue(now)
+		}
+	}
+}
+
+// Updates the jobs from the policies of the volumes currently attached to this server
+func (s *SnapshotScheduler) refresh(now time.Time) {
+	ctx, cancel := s.d.Conf.operationContext(OPERATION_LIST)
+	defer cancel()
+	volumes, err := s.d.Client.ListVolumes(ctx)
+	if err != nil {
+		log.Errorf("Snapshot scheduler could not list volumes: %s", err)
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, vol := range volumes {
+		if !contains(vol.AttachedTo, s.d.Conf.ServerId) {
+			continue
+		}
+		policy := s.d.Conf.snapshotPolicy(vol)
+		if policy.Schedule == "" {
+			continue
+		}
+		seen[vol.Name] = true
+		if job, ok := s.jobs[vol.Name]; ok && job.policy == policy {
+			continue
+		}
+		schedule, err := parseSchedule(policy.Schedule)
+		if err != nil {
+			log.Errorf("Ignoring snapshot schedule of %s: %s", vol.Name, err)
+			continue
+		}
+		job := &snapshotJob{policy: policy, schedule: schedule, next: schedule.Next(now)}
+		s.jobs[vol.Name] = job
+		log.Infof("Scheduled snapshots of %s with %+v, next at %s", vol.Name, policy, job.next)
+	}
+	for name := range s.jobs {
+		if !seen[name] {
+			log.Infof("No longer scheduling snapshots of %s", name)
+			delete(s.jobs, name)
+		}
+	}
+}
+
+func (s *SnapshotScheduler) runDue(now time.Time) {
+	for name, job := range s.jobs {
+		// a schedule without a next time never runs
+		if job.next.IsZero() || now.Before(job.next) {
+			continue
+		}
+		s.snapshot(name, job.policy, now)
+		job.next = job.schedule.Next(time.Now())
+		log.Debugf("Next scheduled snapshot of %s at %s", name, job.next)
+	}
+}
+
+func (s *SnapshotScheduler) snapshot(name string, policy SnapshotPolicy, now time.Time) {
+	snapshotName := fmt.Sprintf("%s%s-%s", SCHEDULED_SNAPSHOT_PREFIX, name, now.UTC().Format("20060102-150405"))
+	log.Infof("Taking scheduled snapshot %s", snapshotName)
+	start := time.Now()
+	ctx, cancel := s.d.Conf.operationContext(OPERATION_SNAPSHOT)
+	defer cancel()
+	snapshot, err := s.d.CreateVolumeSnapshot(ctx, name, snapshotName, policy.Freeze)
+	s.d.Metrics.Set("ovh_scheduled_snapshot_duration_seconds", time.Since(start).Seconds(), "volume", name)
+	if err != nil {
+		log.Errorf("Scheduled snapshot %s failed: %s", snapshotName, err)
+		s.d.Metrics.Add("ovh_scheduled_snapshots_total", 1, "volume", name, "result", "failure")
+		return
+	}
+	log.Infof("Scheduled snapshot %s (%s) finished in %s", snapshotName, snapshot.Id, time.Since(start))
+	s.d.Metrics.Add("ovh_scheduled_snapshots_total", 1, "volume", name, "result", "success")
+	s.d.Metrics.Set("ovh_scheduled_snapshot_last_success_timestamp_seconds", float64(time.Now().Unix()), "volume", name)
+
+	s.prune(ctx, name, policy, now)
+}
+
+// Removes the scheduled snapshots of the volume exceeding the retention policy, always keeping the
+// most recent one
+func (s *SnapshotScheduler) prune(ctx context.Context, name string, policy SnapshotPolicy, now time.Time) {
+	var maxAge time.Duration
+	if policy.MaxAge != "" {
+		var err error
+		if maxAge, err = parseDuration(policy.MaxAge); err != nil {
+			log.Errorf("Not pruning snapshots of %s, invalid maximum age: %s", name, err)
+			return
+		}
+	}
+	if policy.Keep == 0 && maxAge == 0 {
+		return
+	}
+	if err := s.d.Credentials.Allows(rightDeleteSnapshot); err != nil {
+		log.Warningf("Not pruning snapshots of %s: %s", name, err)
+		return
+	}
+
+	snapshots, err := s.d.ListVolumeSnapshots(ctx, name)
+	if err != nil {
+		log.Errorf("Could not list snapshots of %s to prune them: %s", name, err)
+		return
+	}
+	prefix := SCHEDULED_SNAPSHOT_PREFIX + name + "-"
+	var scheduled []Snapshot
+	for _, snapshot := range snapshots {
+		if strings.HasPrefix(snapshot.Name, prefix) && snapshot.Status == "available" {
+			scheduled = append(scheduled, snapshot)
+		}
+	}
+	// the names end in a sortable timestamp, newest first
+	sort.Slice(scheduled, func(i, j int) bool { return scheduled[i].Name > scheduled[j].Name })
+
+	for i, snapshot := range scheduled {
+		if i == 0 {
+			continue
+		}
+		tooMany := policy.Keep > 0 && i >= policy.Keep
+		tooOld := false
+		if created, err := time.Parse(time.RFC3339, snapshot.CreationDate); err == nil && maxAge > 0 {
+			tooOld = now.Sub(created) > maxAge
+		}
+		if !tooMany && !tooOld {
+			continue
+		}
+		log.Infof("Pruning snapshot %s (%s) of %s, created %s", snapshot.Name, snapshot.Id, name, snapshot.CreationDate)
+		if err := s.d.Client.DeleteSnapshot(ctx, snapshot.Id); err != nil {
+			log.Errorf("Failed to prune snapshot %s: %s", snapshot.Id, err)
+			s.d.Metrics.Add("ovh_snapshots_pruned_total", 1, "volume", name, "result", "failure")
+			continue
+		}
+		s.d.Metrics.Add("ovh_snapshots_pruned_total", 1, "volume", name, "result", "success")
+	}
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Maximum difference between the timestamp of a signed request and the simulator clock
+const SIMULATOR_MAX_CLOCK_SKEW = 180 * time.Second
+
+// Settings of the simulated OVH project
+type SimulatorConfig struct {
+	ProjectId         string
+	Region            string
+	ApplicationKey    string
+	ApplicationSecret string
+	ConsumerKey       string
+
+	// Time volumes and snapshots spend in a transitional state such as creating or attaching
+	Delay time.Duration
+	// Fraction of the signed requests failing with a 503 error, to exercise error handling
+	FailureRate float64
+	// Directory of the sparse image files backing the volumes, attached volumes are set up as
+	// loop devices. Without it no devices appear when attaching volumes.
+	LoopDir string
+}
+
+// Fake OVH API serving the volume, snapshot and instance calls of a single project with one
+// instance, this server. Volumes move through the same states as on OVH and requests must be
+// signed with the configured keys, so the plugin can run end to end without an OVH account.
+type Simulator struct {
+	mutex     *sync.Mutex
+	conf      SimulatorConfig
+	volumes   map[string]*Volume
+	snapshots map[string]*Snapshot
+	instance  Instance
+}
+
+// Error returned by the simulated API, encoded the way OVH does
+type simulatorError struct {
+	code    int
+	message string
+}
+
+func NewSimulator(conf SimulatorConfig) (*Simulator, error) {
+	if conf.LoopDir != "" {
+		if err := os.MkdirAll(conf.LoopDir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	hostname, _ := os.Hostname()
+	instance := Instance{
+		Id:      newSimulatorId(),
+		Name:    hostname,
+		Region:  conf.Region,
+		Status:  "ACTIVE",
+		Created: time.Now().UTC().Format(time.RFC3339),
+	}
+	// the plugin finds its instance by the ip addresses of the server
+	ips, err := getIpAddresses()
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		instance.IpAddresses = append(instance.IpAddresses, InstanceIp{Ip: ip, Type: "public", Version: 4})
+	}
+	return &Simulator{
+		mutex:     &sync.Mutex{},
+		conf:      conf,
+		volumes:   map[string]*Volume{},
+		snapshots: map[string]*Snapshot{},
+		instance:  instance,
+	}, nil
+}
+
+// Returns the id of the simulated instance, the ServerId of the plugin
+func (s *Simulator) InstanceId() string {
+	return s.instance.Id
+}
+
+// Detaches the loop devices of the attached volumes, the image files are kept
+func (s *Simulator) Close() {
+	if s.conf.LoopDir == "" {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, vol := range s.volumes {
+		if len(vol.AttachedTo) > 0 {
+			if err := detachLoopDevices(s.imagePath(id)); err != nil {
+				log.Warningf("Failed to detach the loop device of simulated volume %s: %s", id, err)
+			}
+		}
+	}
+}
+
+func (s *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.respond(w, r, http.StatusBadRequest, &simulatorError{http.StatusBadRequest, err.Error()})
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/1.0")
+	if r.Method == "GET" && path == "/auth/time" {
+		s.respond(w, r, http.StatusOK, time.Now().Unix())
+		return
+	}
+	if err := s.authenticate(r, body); err != nil {
+		s.respond(w, r, err.code, err)
+		return
+	}
+	if r.Method == "GET" && path == "/auth/currentCredential" {
+		credential := Credential{Status: "validated", Rules: consumerKeyRules(s.conf.ProjectId, false, false)}
+		s.respond(w, r, http.StatusOK, credential)
+		return
+	}
+	if s.conf.FailureRate > 0 && mathrand.Float64() < s.conf.FailureRate {
+		s.respond(w, r, http.StatusServiceUnavailable, &simulatorError{http.StatusServiceUnavailable, "The service is temporarily unavailable, please retry later"})
+		return
+	}
+
+	s.mutex.Lock()
+	result, apiErr := s.route(r.Method, strings.Split(strings.Trim(path, "/"), "/"), body)
+	s.mutex.Unlock()
+	if apiErr != nil {
+		s.respond(w, r, apiErr.code, apiErr)
+		return
+	}
+	s.respond(w, r, http.StatusOK, result)
+}
+
+func (s *Simulator) respond(w http.ResponseWriter, r *http.Request, code int, result interface{}) {
+	if err, ok := result.(*simulatorError); ok {
+		log.Debugf("Simulator %s %s: %d %s", r.Method, r.URL.Path, err.code, err.message)
+		result = map[string]string{"message": err.message}
+	} else {
+		log.Debugf("Simulator %s %s: %d", r.Method, r.URL.Path, code)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Ovh-QueryID", "SIMULATOR-"+newSimulatorId())
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(result)
+}
+
+// Checks the keys and signature of a request like OVH does, see ovh.Client.CallAPI
+func (s *Simulator) authenticate(r *http.Request, body []byte) *simulatorError {
+	if r.Header.Get("X-Ovh-Application") != s.conf.ApplicationKey {
+		return &simulatorError{http.StatusForbidden, "This application key is invalid"}
+	}
+	if r.Header.Get("X-Ovh-Consumer") != s.conf.ConsumerKey {
+		return &simulatorError{http.StatusForbidden, "This credential does not exist"}
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get("X-Ovh-Timestamp"), 10, 64)
+	if err != nil {
+		return &simulatorError{http.StatusBadRequest, "Invalid timestamp"}
+	}
+	if skew := time.Since(time.Unix(timestamp, 0)); skew > SIMULATOR_MAX_CLOCK_SKEW || skew < -SIMULATOR_MAX_CLOCK_SKEW {
+		return &simulatorError{http.StatusBadRequest, "Query out of time"}
+	}
+	// the signature covers the full url the client used, which is where it reached us
+	url := "http://" + r.Host + r.URL.RequestURI()
+	h := sha1.New()
+	h.Write([]byte(fmt.Sprintf("%s+%s+%s+%s+%s+%d", s.conf.ApplicationSecret, s.conf.ConsumerKey, r.Method, url, body, timestamp)))
+	if r.Header.Get("X-Ovh-Signature") != fmt.Sprintf("$1$%x", h.Sum(nil)) {
+		return &simulatorError{http.StatusBadRequest, "Invalid signature"}
+	}
+	return nil
+}
+
+// Dispatches a request on the path below /cloud/project/<project id>. Called with the lock held.
+func (s *Simulator) route(method string, parts []string, body []byte) (interface{}, *simulatorError) {
+	if len(parts) < 4 || parts[0] != "cloud" || parts[1] != "project" {
+		return nil, &simulatorError{http.StatusNotFound, "Got an invalid (or empty) URL"}
+	}
+	if parts[2] != s.conf.ProjectId {
+		return nil, &simulatorError{http.StatusNotFound, "This service does not exist"}
+	}
+
+	switch resource, rest := parts[3], parts[4:]; {
+	case resource == "instance" && len(rest) == 0 && method == "GET":
+		return []Instance{s.instance}, nil
+	case resource == "volume" && len(rest) == 0 && method == "GET":
+		return s.listVolumes(), nil
+	case resource == "volume" && len(rest) == 0 && method == "POST":
+		var post VolumePost
+		if err := json.Unmarshal(body, &post); err != nil {
+			return nil, &simulatorError{http.StatusBadRequest, err.Error()}
+		}
+		return s.createVolume(post)
+	case resource == "volume" && len(rest) == 1 && rest[0] == "snapshot" && method == "GET":
+		return s.listSnapshots(), nil
+	case resource == "volume" && len(rest) == 2 && rest[0] == "snapshot":
+		snapshot, ok := s.snapshots[rest[1]]
+		if !ok {
+			return nil, &simulatorError{http.StatusNotFound, fmt.Sprintf("Snapshot %s not found", rest[1])}
+		}
+		switch method {
+		case "GET":
+			return *snapshot, nil
+		case "DELETE":
+			return nil, s.deleteSnapshot(snapshot)
+		}
+	case resource == "volume" && len(rest) >= 1:
+		vol, ok := s.volumes[rest[0]]
+		if !ok {
+			return nil, &simulatorError{http.StatusNotFound, fmt.Sprintf("Volume %s not found", rest[0])}
+		}
+		action := ""
+		if len(rest) == 2 {
+			action = rest[1]
+		}
+		switch {
+		case len(rest) > 2:
+		case action == "" && method == "GET":
+			return *vol, nil
+		case action == "" && method == "PUT":
+			var put VolumePut
+			if err := json.Unmarshal(body, &put); err != nil {
+				return nil, &simulatorError{http.StatusBadRequest, err.Error()}
+			}
+			vol.Name = put.Name
+			vol.Description = put.Description
+			return *vol, nil
+		case action == "" && method == "DELETE":
+			return nil, s.deleteVolume(vol)
+		case (action == "attach" || action == "detach") && method == "POST":
+			var post VolumeAttachmentPost
+			if err := json.Unmarshal(body, &post); err != nil {
+				return nil, &simulatorError{http.StatusBadRequest, err.Error()}
+			}
+			if post.InstanceId != s.instance.Id {
+				return nil, &simulatorError{http.StatusNotFound, fmt.Sprintf("Instance %s not found", post.InstanceId)}
+			}
+			if action == "attach" {
+				return s.attachVolume(vol)
+			}
+			return s.detachVolume(vol)
+		case action == "upsize" && method == "POST":
+			var post VolumeUpsizePost
+			if err := json.Unmarshal(body, &post); err != nil {
+				return nil, &simulatorError{http.StatusBadRequest, err.Error()}
+			}
+			return s.upsizeVolume(vol, post.Size)
+		case action == "snapshot" && method == "POST":
+			var post SnapshotPost
+			if err := json.Unmarshal(body, &post); err != nil {
+				return nil, &simulatorError{http.StatusBadRequest, err.Error()}
+			}
+			return s.createSnapshot(vol, post)
+		}
+	}
+	return nil, &simulatorError{http.StatusNotFound, "Got an invalid (or empty) URL"}
+}
+
+func (s *Simulator) listVolumes() []Volume {
+	volumes := []Volume{}
+	for _, vol := range s.volumes {
+		volumes = append(volumes, *vol)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].CreationDate < volumes[j].CreationDate })
+	return volumes
+}
+
+func (s *Simulator) listSnapshots() []Snapshot {
+	snapshots := []Snapshot{}
+	for _, snapshot := range s.snapshots {
+		snapshots = append(snapshots, *snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].CreationDate < snapshots[j].CreationDate })
+	return snapshots
+}
+
+func (s *Simulator) createVolume(post VolumePost) (interface{}, *simulatorError) {
+	if post.Region != s.conf.Region {
+		return nil, &simulatorError{http.StatusBadRequest, fmt.Sprintf("Region %s is not available in this project", post.Region)}
+	}
+	if post.Type != VOLUME_TYPE_CLASSIC && post.Type != VOLUME_TYPE_HIGH_SPEED {
+		return nil, &simulatorError{http.StatusBadRequest, fmt.Sprintf("Invalid volume type %s", post.Type)}
+	}
+	if post.Size < minimumVolumeSize(BACKEND_OVH) || post.Size > MAX_VOLUME_SIZE {
+		return nil, &simulatorError{http.StatusBadRequest, fmt.Sprintf("Volume size must be between %d and %d GB", minimumVolumeSize(BACKEND_OVH), MAX_VOLUME_SIZE)}
+	}
+	var source *Snapshot
+	if post.SnapshotId != "" {
+		snapshot, ok := s.snapshots[post.SnapshotId]
+		if !ok || snapshot.Status != "available" {
+			return nil, &simulatorError{http.StatusBadRequest, fmt.Sprintf("Snapshot %s is not available", post.SnapshotId)}
+		}
+		if post.Size < snapshot.Size {
+			return nil, &simulatorError{http.StatusBadRequest, fmt.Sprintf("Volume size must be at least the %d GB of the snapshot", snapshot.Size)}
+		}
+		source = snapshot
+	}
+	if post.ImageId != "" {
+		return nil, &simulatorError{http.StatusBadRequest, "The simulator does not support creating volumes from images"}
+	}
+
+	vol := &Volume{
+		Id:           newSimulatorId(),
+		Name:         post.Name,
+		Description:  post.Description,
+		AttachedTo:   []string{},
+		Status:       "creating",
+		Region:       post.Region,
+		Type:         post.Type,
+		Size:         post.Size,
+		CreationDate: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	s.volumes[vol.Id] = vol
+	id := vol.Id
+	s.transition(func() error {
+		if s.conf.LoopDir == "" {
+			return nil
+		}
+		if source != nil {
+			if err := copySparse(s.imagePath(source.Id), s.imagePath(id)); err != nil {
+				return err
+			}
+		}
+		return resizeImage(s.imagePath(id), post.Size)
+	}, func(err error) {
+		if vol, ok := s.volumes[id]; ok {
+			vol.Status = statusAfter(err, "available")
+		}
+	})
+	return *vol, nil
+}
+
+func (s *Simulator) deleteVolume(vol *Volume) *simulatorError {
+	if vol.Status != "available" || len(vol.AttachedTo) > 0 {
+		return &simulatorError{http.StatusBadRequest, fmt.Sprintf("Volume %s is %s, it must be available to be deleted", vol.Id, vol.Status)}
+	}
+	for _, snapshot := range s.snapshots {
+		if snapshot.VolumeId == vol.Id {
+			return &simulatorError{http.StatusBadRequest, fmt.Sprintf("Volume %s still has dependent snapshots", vol.Id)}
+		}
+	}
+	vol.Status = "deleting"
+	id := vol.Id
+	s.transition(func() error {
+		return s.removeImage(id)
+	}, func(err error) {
+		if err != nil {
+			s.volumes[id].Status = "error"
+		} else {
+			delete(s.volumes, id)
+		}
+	})
+	return nil
+}
+
+func (s *Simulator) attachVolume(vol *Volume) (interface{}, *simulatorError) {
+	if vol.Status != "available" {
+		return nil, &simulatorError{http.StatusBadRequest, fmt.Sprintf("Volume %s is %s, it must be available to be attached", vol.Id, vol.Status)}
+	}
+	vol.Status = "attaching"
+	id := vol.Id
+	s.transition(func() error {
+		if s.conf.LoopDir == "" {
+			return nil
+		}
+		device, err := attachLoopDevice(s.imagePath(id))
+		if err == nil {
+			log.Infof("Simulator attached volume %s as %s", id, device)
+		}
+		return err
+	}, func(err error) {
+		if vol, ok := s.volumes[id]; ok {
+			vol.Status = statusAfter(err, "in-use")
+			if err == nil {
+				vol.AttachedTo = []string{s.instance.Id}
+			}
+		}
+	})
+	return *vol, nil
+}
+
+func (s *Simulator) detachVolume(vol *Volume) (interface{}, *simulatorError) {
+	if vol.Status != "in-use" || !contains(vol.AttachedTo, s.instance.Id) {
+		return nil, &simulatorError{http.StatusBadRequest, fmt.Sprintf("Volume %s is not attached to instance %s", vol.Id, s.instance.Id)}
+	}
+	vol.Status = "detaching"
+	id := vol.Id
+	s.transition(func() error {
+		if s.conf.LoopDir == "" {
+			return nil
+		}
+		return detachLoopDevices(s.imagePath(id))
+	}, func(err error) {
+		if vol, ok := s.volumes[id]; ok {
+			if err != nil {
+				// like a detach refused by the hypervisor, the volume stays attached
+				vol.Status = "in-use"
+				return
+			}
+			vol.Status = "available"
+			vol.AttachedTo = []string{}
+		}
+	})
+	return *vol, nil
+}
+
+func (s *Simulator) upsizeVolume(vol *Volume, size int) (interface{}, *simulatorError) {
+	if vol.Status != "available" && vol.Status != "in-use" {
+		return nil, &simulatorError{http.StatusBadRequest, fmt.Sprintf("Volume %s is %s, it cannot be resized", vol.Id, vol.Status)}
+	}
+	if size <= vol.Size || size > MAX_VOLUME_SIZE {
+		return nil, &simulatorError{http.StatusBadRequest, fmt.Sprintf("New size must be larger than %d GB and at most %d GB", vol.Size, MAX_VOLUME_SIZE)}
+	}
+	previous := vol.Status
+	vol.Status = "extending"
+	id := vol.Id
+	s.transition(func() error {
+		if s.conf.LoopDir == "" {
+			return nil
+		}
+		if err := resizeImage(s.imagePath(id), size); err != nil {
+			return err
+		}
+		return refreshLoopDevices(s.imagePath(id))
+	}, func(err error) {
+		if vol, ok := s.volumes[id]; ok {
+			vol.Status = statusAfter(err, previous)
+			if err == nil {
+				vol.Size = size
+			}
+		}
+	})
+	return *vol, nil
+}
+
+func (s *Simulator) createSnapshot(vol *Volume, post SnapshotPost) (interface{}, *simulatorError) {
+	if vol.Status != "available" && vol.Status != "in-use" {
+		return nil, &simulatorError{http.StatusBadRequest, fmt.Sprintf("Volume %s is %s, it cannot be snapshotted", vol.Id, vol.Status)}
+	}
+	snapshot := &Snapshot{
+		Id:           newSimulatorId(),
+		Name:         post.Name,
+		Description:  post.Description,
+		VolumeId:     vol.Id,
+		Region:       vol.Region,
+		Size:         vol.Size,
+		Status:       "creating",
+		CreationDate: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	s.snapshots[snapshot.Id] = snapshot
+	id, volumeId := snapshot.Id, vol.Id
+	s.transition(func() error {
+		if s.conf.LoopDir == "" {
+			return nil
+		}
+		return copySparse(s.imagePath(volumeId), s.imagePath(id))
+	}, func(err error) {
+		if snapshot, ok := s.snapshots[id]; ok {
+			snapshot.Status = statusAfter(err, "available")
+		}
+	})
+	return *snapshot, nil
+}
+
+func (s *Simulator) deleteSnapshot(snapshot *Snapshot) *simulatorError {
+	if snapshot.Status != "available" && snapshot.Status != "error" {
+		return &simulatorError{http.StatusBadRequest, fmt.Sprintf("Snapshot %s is %s, it cannot be deleted", snapshot.Id, snapshot.Status)}
+	}
+	snapshot.Status = "deleting"
+	id := snapshot.Id
+	s.transition(func() error {
+		return s.removeImage(id)
+	}, func(err error) {
+		if err != nil {
+			s.snapshots[id].Status = "error"
+		} else {
+			delete(s.snapshots, id)
+		}
+	})
+	return nil
+}
+
+// Completes an operation asynchronously after the configured delay. The work runs without the
+// lock, the result is then applied with the lock held.
+func (s *Simulator) transition(work func() error, apply func(error)) {
+	time.AfterFunc(s.conf.Delay, func() {
+		err := work()
+		if err != nil {
+			log.Errorf("Simulated operation failed: %s", err)
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		apply(err)
+	})
+}
+
+// Returns the status to move to after a transition, OVH reports failures with the error state
+func statusAfter(err error, status string) string {
+	if err != nil {
+		return "error"
+	}
+	return status
+}
+
+func (s *Simulator) imagePath(id string) string {
+	return filepath.Join(s.conf.LoopDir, id+".img")
+}
+
+func (s *Simulator) removeImage(id string) error {
+	if s.conf.LoopDir == "" {
+		return nil
+	}
+	if err := os.Remove(s.imagePath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Returns a random id formatted like the UUIDs of OVH resources
+func newSimulatorId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Grows a sparse image file to the given size in GBs, creating it if needed
+func resizeImage(path string, size int) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Truncate(int64(size) * GB)
+}
+
+// Copies an image file without allocating its holes
+func copySparse(source, target string) error {
+	out, err := exec.Command("cp", "--sparse=always", source, target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Sets up a loop device backed by the image file and returns its path
+func attachLoopDevice(path string) (string, error) {
+	out, err := exec.Command("losetup", "--find", "--show", path).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Returns the loop devices backed by the image file
+func loopDevicesOf(path string) ([]string, error) {
+	out, err := exec.Command("losetup", "--associated", path).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	// /dev/loop0: [2049]:1234 (/var/lib/ovh-volume-plugin/simulator/<id>.img)
+	var devices []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if i := strings.Index(line, ":"); i > 0 {
+			devices = append(devices, line[:i])
+		}
+	}
+	return devices, nil
+}
+
+// Detaches the loop devices backed by the image file
+func detachLoopDevices(path string) error {
+	devices, err := loopDevicesOf(path)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if out, err := exec.Command("losetup", "--detach", device).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// Makes the loop devices backed by the image file pick up its new size
+func refreshLoopDevices(path string) error {
+	devices, err := loopDevicesOf(path)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if out, err := exec.Command("losetup", "--set-capacity", device).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// Finds a snapshot by its id, or by its name if that is unique
+func (d OVHPlugin) findSnapshot(ctx context.Context, idOrName string) (Snapshot, error) {
+	snapshot, err := d.Client.GetSnapshot(ctx, idOrName)
+	if err != nil || snapshot.Id != "" {
+		return snapshot, err
+	}
+
+	snapshots, err := d.Client.ListSnapshots(ctx)
+	if err != nil {
+		return snapshot, err
+	}
+	var matches []Snapshot
+	for _, s := range snapshots {
+		if s.Name == idOrName {
+			matches = append(matches, s)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return snapshot, fmt.Errorf("Snapshot %s could not be found", idOrName)
+	case 1:
+		return matches[0], nil
+	default:
+		return snapshot, fmt.Errorf("There are %d snapshots named %s, use the snapshot id instead", len(matches), idOrName)
+	}
+}
+
+// Takes the intermediate snapshot used to clone the Docker volume `from` into a new volume and
+// points the creation options at it. The new volume inherits the type and filesystem settings of
+// the source unless they were given explicitly.
+func (d OVHPlugin) snapshotForClone(ctx context.Context, from string, createOptions *VolumePost, userOptions map[string]string) (Snapshot, error) {
+	source, err := d.findVolume(ctx, from)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if source.Id == "" {
+		return Snapshot{}, fmt.Errorf("Source volume %s could not be found", from)
+	}
+	meta := decodeDescription(createOptions.Description)
+	for k, v := range decodeDescription(source.Description) {
+		if _, ok := userOptions[k]; !ok {
+			meta[k] = v
+		}
+	}
+	description := encodeDescription(meta)
+	if err := checkDescription(createOptions.Name, description); err != nil {
+		return Snapshot{}, err
+	}
+
+	log.Infof("Creating intermediate snapshot of %s (%s) to clone it into %s", from, source.Id, createOptions.Name)
+	created, err := d.Client.CreateSnapshot(ctx, source.Id, SnapshotPost{
+		Name:        "docker-clone-" + createOptions.Name,
+		Description: fmt.Sprintf("Intermediate snapshot of %s to create %s", from, createOptions.Name),
+	})
+	snapshot := created
+	if err == nil {
+		snapshot, err = d.Client.WaitForSnapshot(ctx, created.Id)
+	}
+	if err != nil {
+		if created.Id != "" {
+			d.removeCloneSnapshot(created)
+		}
+		return Snapshot{}, fmt.Errorf("Failed to snapshot source volume %s: %s", from, err)
+	}
+
+	createOptions.SnapshotId = snapshot.Id
+	createOptions.Region = source.Region
+	if createOptions.Size < source.Size {
+		createOptions.Size = source.Size
+	}
+	if _, ok := userOptions["type"]; !ok {
+		createOptions.Type = source.Type
+	}
+	createOptions.Description = description
+	return snapshot, nil
+}
+
+// Deletes the intermediate snapshot of a clone, failures are only logged since the clone itself
+// is usable regardless. It gets a deadline of its own, as the clone may have run out of time.
+func (d OVHPlugin) removeCloneSnapshot(snapshot Snapshot) {
+	log.Infof("Deleting intermediate snapshot %s", snapshot.Id)
+	ctx, cancel := d.Conf.operationContext(OPERATION_SNAPSHOT)
+	defer cancel()
+	if err := d.Client.DeleteSnapshot(ctx, snapshot.Id); err != nil {
+		log.Warningf("Failed to delete intermediate snapshot %s, please remove it manually: %s", snapshot.Id, err)
+	}
+}
+
+// Lists the snapshots of the given Docker volume, or all snapshots in the project if no volume is given
+func (d OVHPlugin) ListVolumeSnapshots(ctx context.Context, name string) ([]Snapshot, error) {
+	snapshots, err := d.Client.ListSnapshots(ctx)
+	if err != nil || name == "" {
+		return snapshots, err
+	}
+	vol, err := d.findVolume(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if vol.Id == "" {
+		return nil, fmt.Errorf("Volume with name %s could not be found", name)
+	}
+	var result []Snapshot
+	for _, snapshot := range snapshots {
+		if snapshot.VolumeId == vol.Id {
+			result = append(result, snapshot)
+		}
+	}
+	return result, nil
+}
+
+// Takes a snapshot of the given Docker volume. With freeze set, the filesystem of a volume mounted
+// on this server is frozen until OVH finished the snapshot or FreezeTimeout passed, whichever
+// comes first, so the snapshot is crash-consistent.
+func (d OVHPlugin) CreateVolumeSnapshot(ctx context.Context, name, snapshotName string, freeze bool) (Snapshot, error) {
+	if err := d.Credentials.Allows(rightCreateSnapshot); err != nil {
+		return Snapshot{}, err
+	}
+	vol, err := d.findVolume(ctx, name)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if vol.Id == "" {
+		return Snapshot{}, fmt.Errorf("Volume with name %s could not be found", name)
+	}
+	if snapshotName == "" {
+		snapshotName = fmt.Sprintf("%s-%s", name, time.Now().UTC().Format("20060102-150405"))
+	}
+
+	// thaws the frozen filesystem and releases the volume lock, either once FreezeTimeout passed
+	// or when returning
+	thaw := func() {}
+	if freeze {
+		// prevent the volume from being unmounted while it is frozen
+		if err := d.lock(ctx, name); err != nil {
+			return Snapshot{}, err
+		}
+		once := &sync.Once{}
+		unlock := func() {
+			once.Do(func() { d.unlock(name) })
+		}
+		defer unlock()
+		vs, _ := d.State.Get(name)
+		if !vs.Mounted {
+			return Snapshot{}, fmt.Errorf("Volume %s is not mounted on this server, it cannot be frozen", name)
+		}
+		path := d.mountPath(name)
+		log.Infof("Freezing filesystem of %s at %s", name, path)
+		if err := FreezeFilesystem(ctx, path); err != nil {
+			return Snapshot{}, fmt.Errorf("Failed to freeze %s: %s", name, err)
+		}
+		thawOnce := &sync.Once{}
+		thaw = func() {
+			thawOnce.Do(func() {
+				if err := ThawFilesystem(path); err != nil {
+					log.Errorf("Failed to thaw filesystem of %s at %s, run `fsfreeze --unfreeze %s`: %s", name, path, path, err)
+				} else {
+					log.Infof("Thawed filesystem of %s", name)
+				}
+				unlock()
+			})
+		}
+		defer thaw()
+	}
+
+	log.Infof("Creating snapshot %s of volume %s (%s)", snapshotName, name, vol.Id)
+	created, err := d.Client.CreateSnapshot(ctx, vol.Id, SnapshotPost{
+		Name:        snapshotName,
+		Description: fmt.Sprintf("Snapshot of Docker volume %s", name),
+	})
+	if err != nil {
+		return created, err
+	}
+	if !freeze {
+		return d.Client.WaitForSnapshot(ctx, created.Id)
+	}
+
+	// keep the filesystem frozen while OVH takes the snapshot, but never longer than FreezeTimeout
+	snapshot, err := d.Client.WaitForSnapshotStatus(ctx, created.Id, "snapshot", []string{"available"}, []string{"creating"}, d.Conf.timeout(d.Conf.FreezeTimeout))
+	if _, timedOut := err.(*StateTimeoutError); timedOut {
+		log.Warningf("Snapshot %s is not finished after %d seconds, thawing %s", created.Id, d.Conf.FreezeTimeout, name)
+		thaw()
+		// the volume is unlocked again, so it can be unmounted while OVH finishes the snapshot
+		return d.Client.WaitForSnapshot(ctx, created.Id)
+	}
+	return snapshot, err
+}
+
+// Deletes a snapshot by its id or unique name
+func (d OVHPlugin) DeleteVolumeSnapshot(ctx context.Context, idOrName string) error {
+	if err := d.Credentials.Allows(rightDeleteSnapshot); err != nil {
+		return err
+	}
+	snapshot, err := d.findSnapshot(ctx, idOrName)
+	if err != nil {
+		return err
+	}
+	log.Infof("Deleting snapshot %s (%s)", snapshot.Name, snapshot.Id)
+	return d.Client.DeleteSnapshot(ctx, snapshot.Id)
+}
+
+// Restores a snapshot into a new Docker volume. OVH does not support reverting a volume in place,
+// so the original volume is left untouched.
+func (d OVHPlugin) RestoreSnapshot(ctx context.Context, idOrName, name string) (Volume, error) {
+	snapshot, err := d.findSnapshot(ctx, idOrName)
+	if err != nil {
+		return Volume{}, err
+	}
+	existing, err := d.findVolume(ctx, name)
+	if err != nil {
+		return Volume{}, err
+	}
+	if existing.Id != "" {
+		return Volume{}, fmt.Errorf("Volume %s already exists, restore the snapshot into a new volume", name)
+	}
+
+	log.Infof("Restoring snapshot %s (%s) into new volume %s", snapshot.Name, snapshot.Id, name)
+	if err := d.create(ctx, &volume.CreateRequest{Name: name, Options: map[string]string{"snapshot": snapshot.Id}}); err != nil {
+		return Volume{}, err
+	}
+	return d.findVolume(ctx, name)
+}
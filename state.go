@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const STATE_FILE = "state.json"
+
+// Local state of a volume used on this server
+type VolumeState struct {
+	Id       string            // OVH volume id
+	Region   string            // OVH region the volume lives in
+	Device   string            // block device the volume was last found on
+	FSType   string            // filesystem on the device
+	Mounted  bool              // whether the volume is mounted on its mount point
+	Options  map[string]string // options the volume was created with
+	Fresh    bool              // created by this plugin and never formatted, so it cannot hold any data
+	Mapping  string            // device mapper name of an opened encrypted volume
+	LastFsck *FsckResult       // result of the last filesystem check before mounting
+
+	// Docker mount ids of the containers using this volume, an empty id is used for every mount
+	// request of Docker versions that do not provide mount ids
+	MountIDs []string
+}
+
+// Keeps track of the local volume state in a single file, so it survives a restart of the plugin.
+// Every change is written to disk before it is reported as done.
+type StateStore struct {
+	mutex   *sync.Mutex
+	path    string
+	volumes map[string]*VolumeState
+}
+
+// Opens the state store in the given directory, loading the existing state if present
+func NewStateStore(dir string) (*StateStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &StateStore{
+		mutex:   &sync.Mutex{},
+		path:    filepath.Join(dir, STATE_FILE),
+		volumes: map[string]*VolumeState{},
+	}
+	// a leftover temporary file means we crashed while saving, the previous state is still intact
+	os.Remove(s.path + ".tmp")
+
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		log.Infof("No existing state found at %s, starting with an empty state", s.path)
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &s.volumes); err != nil {
+		return nil, err
+	}
+	log.Infof("Loaded state of %d volumes from %s", len(s.volumes), s.path)
+	return s, nil
+}
+
+// Returns a copy of the state of the given volume and whether it is known
+func (s *StateStore) Get(name string) (VolumeState, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	vs, ok := s.volumes[name]
+	if !ok {
+		return VolumeState{}, false
+	}
+	return vs.copy(), true
+}
+
+// Returns the names of all known volumes, sorted by name
+func (s *StateStore) Names() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	names := make([]string, 0, len(s.volumes))
+	for name := range s.volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Applies the given change to the state of the volume, creating it if needed, and persists the result
+func (s *StateStore) Update(name string, change func(vs *VolumeState)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	vs := VolumeState{}
+	if current, ok := s.volumes[name]; ok {
+		vs = current.copy()
+	}
+	change(&vs)
+	return s.put(name, &vs)
+}
+
+// Forgets the given volume
+func (s *StateStore) Delete(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.volumes[name]; !ok {
+		return nil
+	}
+	return s.put(name, nil)
+}
+
+// Returns the number of active mounts of the given volume
+func (s *StateStore) MountCount(name string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if vs, ok := s.volumes[name]; ok {
+		return len(vs.MountIDs)
+	}
+	return 0
+}
+
+// Records a mount of the volume by the given mount id
+func (s *StateStore) AddMount(name, id string) error {
+	return s.Update(name, func(vs *VolumeState) {
+		if id != "" && contains(vs.MountIDs, id) {
+			log.Debugf("Mount %s of volume %s is already known", id, name)
+			return
+		}
+		vs.MountIDs = append(vs.MountIDs, id)
+	})
+}
+
+// Removes a mount of the volume by the given mount id and returns the number of mounts left
+func (s *StateStore) RemoveMount(name, id string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.volumes[name]
+	if !ok {
+		return 0, nil
+	}
+	vs := current.copy()
+	for i, mountId := range vs.MountIDs {
+		if mountId == id {
+			vs.MountIDs = append(vs.MountIDs[:i], vs.MountIDs[i+1:]...)
+			break
+		}
+	}
+	if err := s.put(name, &vs); err != nil {
+		return len(current.MountIDs), err
+	}
+	return len(vs.MountIDs), nil
+}
+
+// Persists the state with the given volume replaced, or removed if nil, and only takes it over
+// once it is on disk, so a failed write leaves the state in memory unchanged
+func (s *StateStore) put(name string, vs *VolumeState) error {
+	volumes := make(map[string]*VolumeState, len(s.volumes)+1)
+	for k, v := range s.volumes {
+		volumes[k] = v
+	}
+	if vs == nil {
+		delete(volumes, name)
+	} else {
+		volumes[name] = vs
+	}
+	if err := s.save(volumes); err != nil {
+		return err
+	}
+	s.volumes = volumes
+	return nil
+}
+
+// Writes the state to a temporary file, syncs it and moves it in place, so a crash at any point
+// leaves either the old or the new state on disk but never a partial file
+func (s *StateStore) save(volumes map[string]*VolumeState) error {
+	content, err := json.MarshalIndent(volumes, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+
+	// sync the directory as well, otherwise the rename itself may be lost
+	dir, err := os.Open(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (vs *VolumeState) copy() VolumeState {
+	c := *vs
+	c.MountIDs = append([]string(nil), vs.MountIDs...)
+	if vs.Options != nil {
+		c.Options = map[string]string{}
+		for k, v := range vs.Options {
+			c.Options[k] = v
+		}
+	}
+	return c
+}
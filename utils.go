@@ -1,86 +1,182 @@
 package main
 
 import (
-	"errors"
+	"bufio"
+	"context"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
 	"net"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"time"
+
+	"github.com/opencontainers/runc/libcontainer/user"
 )
 
-func waitForPathToExist(fileName string, numTries int) string {
-	log.Infof("Waiting for path %s", fileName)
-	for i := 0; i < numTries; i++ {
-		matches, err := filepath.Glob(fileName)
+// Returns the glob matching the udev by-id link of an attached volume, which ends in the first
+// 20 characters of the volume id, the serial of its virtio device
+func devicePathForVolume(volumeId string) string {
+	if len(volumeId) > 20 {
+		volumeId = volumeId[0:20]
+	}
+	return "/dev/disk/by-id/*" + volumeId
+}
 
-		if err != nil {
-			log.Errorf("Received error from os.Glob: %s", err)
-			return ""
-		}
+// Returns the mounted filesystems below the given directory, as a map from mount point to the
+// mounted device, based on /proc/self/mountinfo
+func getMounts(dir string) (map[string]string, error) {
+	mounts := map[string]string{}
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return mounts, err
+	}
+	defer f.Close()
 
-		if matches != nil {
-			return matches[0]
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 5 || separator < 0 || len(fields) < separator+3 {
+			continue
+		}
+		mountPoint := unescapeMountInfo(fields[4])
+		if mountPoint == dir || strings.HasPrefix(mountPoint, dir+"/") {
+			mounts[mountPoint] = unescapeMountInfo(fields[separator+2])
 		}
-		time.Sleep(time.Second)
 	}
-	return ""
+	return mounts, scanner.Err()
 }
 
-func GetFSType(device string) string {
-	log.Debugf("Begin utils.GetFSType: %s", device)
-	fsType := ""
-	out, err := exec.Command("blkid", device).CombinedOutput()
-	if err != nil {
-		return fsType
+// Reverses the octal escaping of spaces and other special characters used in mountinfo
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
 	}
-
-	if strings.Contains(string(out), "TYPE=") {
-		for _, v := range strings.Split(string(out), " ") {
-			if strings.Contains(v, "TYPE=") {
-				fsType = strings.Split(v, "=")[1]
-				fsType = strings.Replace(fsType, "\"", "", -1)
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(c))
+				i += 3
+				continue
 			}
 		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// Returns the id of the current boot, which changes every time the server is restarted
+func getBootId() string {
+	content, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		log.Warningf("Could not determine boot id: %s", err)
+		return ""
 	}
-	return fsType
+	return strings.TrimSpace(string(content))
 }
 
-func FormatVolume(device, fsType string) error {
-	log.Debugf("Begin utils.FormatVolume: %s, %s", device, fsType)
-	cmd := "mkfs.ext4"
-	if fsType == "xfs" {
-		cmd = "mkfs.xfs"
+func FormatVolume(ctx context.Context, device, fsType, mkfsOpts string) error {
+	log.Debugf("Begin utils.FormatVolume: %s, %s, %s", device, fsType, mkfsOpts)
+	cmd := "mkfs." + fsType
+	// force creating the filesystem on a whole device rather than a partition
+	args := []string{"-F"}
+	if fsType == "xfs" || fsType == "btrfs" {
+		args = []string{"-f"}
 	}
-	log.Debug("Perform ", cmd, " on device: ", device)
-	out, err := exec.Command(cmd, "-F", device).CombinedOutput()
+	args = append(args, strings.Fields(mkfsOpts)...)
+	args = append(args, device)
+	log.Debug("Perform ", cmd, " ", args)
+	out, err := exec.CommandContext(ctx, cmd, args...).CombinedOutput()
 	log.Debug("Result of mkfs cmd: ", string(out))
-	return err
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
 }
 
-func Mount(device, mountpoint string) error {
-	log.Debugf("Begin utils.Mount device: %s on: %s", device, mountpoint)
-	out, err := exec.Command("mkdir", mountpoint).CombinedOutput()
-	out, err = exec.Command("mount", device, mountpoint).CombinedOutput()
-	log.Debug("Response from mount ", device, " at ", mountpoint, ": ", string(out))
+// Grows the mounted filesystem to fill its device
+func GrowFilesystem(ctx context.Context, device, mountpoint, fsType string) error {
+	log.Debugf("Begin utils.GrowFilesystem: %s, %s, %s", device, mountpoint, fsType)
+	var cmd string
+	var args []string
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		cmd, args = "resize2fs", []string{device}
+	case "xfs":
+		cmd, args = "xfs_growfs", []string{mountpoint}
+	case "btrfs":
+		cmd, args = "btrfs", []string{"filesystem", "resize", "max", mountpoint}
+	default:
+		return fmt.Errorf("Growing %s filesystems is not supported", fsType)
+	}
+	out, err := exec.CommandContext(ctx, cmd, args...).CombinedOutput()
+	log.Debug("Result of ", cmd, " cmd: ", string(out))
 	if err != nil {
-		log.Error("Error in mount: ", err)
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Asks the kernel to re-read the size of a SCSI device, virtio devices pick up the new size
+// by themselves
+func RescanDevice(device string) error {
+	rescan := sysBlockPath(device, "device/rescan")
+	if _, err := os.Stat(rescan); os.IsNotExist(err) {
+		return nil
 	}
-	return err
+	log.Debugf("Rescanning device %s", device)
+	return ioutil.WriteFile(rescan, []byte("1"), 0200)
 }
 
-func Umount(mountpoint string) error {
-	log.Debugf("Begin utils.Umount: %s", mountpoint)
-	out, err := exec.Command("umount", mountpoint).CombinedOutput()
+// Returns the size of a block device in bytes as seen by the kernel
+func DeviceSize(device string) (int64, error) {
+	data, err := ioutil.ReadFile(sysBlockPath(device, "size"))
 	if err != nil {
-		log.Warningf("Unmount call returned error: %s (%s)", err, out)
-		if strings.Contains(string(out), "not mounted") {
-			log.Debug("Ignore request for unmount on unmounted volume")
-			err = errors.New("Volume is not mounted")
-		}
+		return 0, err
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	// the kernel always counts in 512 byte sectors here, regardless of the device
+	return sectors * 512, err
+}
+
+// Returns the path of a sysfs attribute of a block device, resolving /dev/disk/by-id links
+func sysBlockPath(device, attribute string) string {
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		device = resolved
 	}
-	return err
+	return filepath.Join("/sys/class/block", filepath.Base(device), attribute)
+}
+
+// Suspends all writes to the filesystem mounted at mountpoint and flushes it to disk
+func FreezeFilesystem(ctx context.Context, mountpoint string) error {
+	log.Debugf("Begin utils.FreezeFilesystem: %s", mountpoint)
+	out, err := exec.CommandContext(ctx, "fsfreeze", "--freeze", mountpoint).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Resumes writes to a filesystem frozen by FreezeFilesystem. It takes no context, a filesystem must
+// never be left frozen because an operation ran out of time.
+func ThawFilesystem(mountpoint string) error {
+	log.Debugf("Begin utils.ThawFilesystem: %s", mountpoint)
+	out, err := exec.Command("fsfreeze", "--unfreeze", mountpoint).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
 }
 
 func getIpAddresses() (ips []string, error error) {
@@ -105,3 +201,29 @@ func getIpAddresses() (ips []string, error error) {
 
 	return ips, nil
 }
+
+// Returns the id of the group owning the plugin sockets, given by name or id. The docker group is
+// optional, root is used when it does not exist.
+func socketGroupId(group string) (int, error) {
+	groupFile, err := user.GetGroupPath()
+	if err != nil {
+		return -1, err
+	}
+	groups, err := user.ParseGroupFileFilter(groupFile, func(g user.Group) bool {
+		return g.Name == group || strconv.Itoa(g.Gid) == group
+	})
+	if err != nil {
+		return -1, err
+	}
+	if len(groups) > 0 {
+		return groups[0].Gid, nil
+	}
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	if group == "docker" {
+		log.Debugf("Group docker not found, the sockets will be owned by root")
+		return 0, nil
+	}
+	return -1, fmt.Errorf("Group %s not found", group)
+}
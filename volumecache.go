@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Keeps the volume listing of the project for a short time, so looking up volumes by name does not
+// list the whole project for every Docker request. Concurrent listings share a single API call.
+type VolumeCache struct {
+	mutex   *sync.Mutex
+	ttl     time.Duration
+	volumes []Volume
+	expires time.Time
+	// incremented by Invalidate, a listing started before the change is then not cached
+	generation int
+	inflight   *volumeListing
+}
+
+// Listing in progress, which other callers wait for rather than starting their own
+type volumeListing struct {
+	done    chan struct{}
+	volumes []Volume
+	err     error
+	// the listing failed because the context of the caller that started it was done
+	abandoned bool
+}
+
+// Creates a cache keeping listings for ttl, a ttl of 0 or less only coalesces concurrent listings
+func NewVolumeCache(ttl time.Duration) *VolumeCache {
+	return &VolumeCache{mutex: &sync.Mutex{}, ttl: ttl}
+}
+
+// Returns the cached listing while it is fresh, otherwise lists the volumes using list. The
+// second return value tells whether the listing came from the cache.
+func (c *VolumeCache) Get(ctx context.Context, list func(context.Context) ([]Volume, error)) ([]Volume, bool, error) {
+	for {
+		c.mutex.Lock()
+		if c.volumes != nil && time.Now().Before(c.expires) {
+			volumes := c.volumes
+			c.mutex.Unlock()
+			return copyVolumes(volumes), true, nil
+		}
+		if call := c.inflight; call != nil {
+			c.mutex.Unlock()
+			log.Debug("Waiting for the volume listing already in progress")
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			}
+			if call.abandoned {
+				// the caller that started the listing gave up on it, we still have time to list again
+				continue
+			}
+			return copyVolumes(call.volumes), false, call.err
+		}
+		call := &volumeListing{done: make(chan struct{})}
+		c.inflight = call
+		generation := c.generation
+		c.mutex.Unlock()
+
+		call.volumes, call.err = list(ctx)
+		call.abandoned = call.err != nil && ctx.Err() != nil
+
+		c.mutex.Lock()
+		if c.inflight == call {
+			c.inflight = nil
+		}
+		if call.err == nil && generation == c.generation && c.ttl > 0 {
+			c.volumes = call.volumes
+			c.expires = time.Now().Add(c.ttl)
+		}
+		c.mutex.Unlock()
+		close(call.done)
+		return copyVolumes(call.volumes), false, call.err
+	}
+}
+
+// Drops the cached listing after a volume changed. A listing in progress may predate the change,
+// so later callers start a new one instead of waiting for it.
+func (c *VolumeCache) Invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.volumes = nil
+	c.generation++
+	c.inflight = nil
+}
+
+func copyVolumes(volumes []Volume) []Volume {
+	if volumes == nil {
+		return nil
+	}
+	return append([]Volume{}, volumes...)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Pseudo status used while waiting for a volume or snapshot to be deleted
+const STATUS_DELETED = "deleted"
+
+// Returned when a volume or snapshot lands in the OVH "error" state while waiting for it
+type ErrorStateError struct {
+	Resource  string
+	Id        string
+	Operation string
+}
+
+func (e *ErrorStateError) Error() string {
+	return fmt.Sprintf("%s %s went into the error state during %s", e.Resource, e.Id, e.Operation)
+}
+
+// Returned when a volume or snapshot lands in a state that is neither the target nor a transitional state
+type UnexpectedStateError struct {
+	Resource  string
+	Id        string
+	Operation string
+	Status    string
+	Expected  []string
+}
+
+func (e *UnexpectedStateError) Error() string {
+	return fmt.Sprintf("%s %s is in unexpected state %s during %s, expected %s", e.Resource, e.Id, e.Status, e.Operation, strings.Join(e.Expected, " or "))
+}
+
+// Returned when a volume or snapshot does not reach the target state in time
+type StateTimeoutError struct {
+	Resource  string
+	Id        string
+	Operation string
+	Status    string
+	Timeout   time.Duration
+}
+
+func (e *StateTimeoutError) Error() string {
+	return fmt.Sprintf("%s %s is still %s after waiting %s for %s to complete", e.Resource, e.Id, e.Status, e.Timeout, e.Operation)
+}
+
+// Exponentially increasing delay between two polls, capped at max
+type backoff struct {
+	delay time.Duration
+	max   time.Duration
+}
+
+func newBackoff(initial, max time.Duration) *backoff {
+	return &backoff{delay: initial, max: max}
+}
+
+func (b *backoff) next() time.Duration {
+	delay := b.delay
+	b.delay *= 2
+	if b.delay > b.max {
+		b.delay = b.max
+	}
+	return delay
+}
+
+// Returns the next delay shortened by a random amount of up to half, so clients retrying at the
+// same time spread out
+func (b *backoff) nextJittered() time.Duration {
+	delay := b.next()
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Sleeps for the next delay, but never past the deadline. Returns false once the deadline passed
+// or the context is done.
+func (b *backoff) wait(ctx context.Context, deadline time.Time) bool {
+	remaining := deadline.Sub(time.Now())
+	if remaining <= 0 || ctx.Err() != nil {
+		return false
+	}
+	delay := b.next()
+	if delay > remaining {
+		delay = remaining
+	}
+	select {
+	case <-time.After(delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Polls the status of a volume or snapshot until it reaches one of the target states, as long as
+// it stays in one of the transitional states
+func waitForStatus(ctx context.Context, resource, id, operation string, target, transitional []string, timeout time.Duration, getStatus func() (string, error)) error {
+	deadline := time.Now().Add(timeout)
+	b := newBackoff(time.Second, 15*time.Second)
+	for {
+		status, err := getStatus()
+		if err != nil {
+			return err
+		}
+		log.Debugf("%s %s is %s while waiting for %s", resource, id, status, operation)
+
+		switch {
+		case contains(target, status):
+			return nil
+		case status == "error":
+			return &ErrorStateError{Resource: resource, Id: id, Operation: operation}
+		case !contains(transitional, status):
+			return &UnexpectedStateError{Resource: resource, Id: id, Operation: operation, Status: status, Expected: target}
+		}
+
+		if !b.wait(ctx, deadline) {
+			if ctx.Err() != nil {
+				return fmt.Errorf("Gave up waiting for %s of %s %s while it is %s: %s", operation, strings.ToLower(resource), id, status, ctx.Err())
+			}
+			return &StateTimeoutError{Resource: resource, Id: id, Operation: operation, Status: status, Timeout: timeout}
+		}
+	}
+}
+
+// Polls a single volume until it reaches one of the target states. A deleted volume is reported
+// with the STATUS_DELETED status.
+func (c CloudClient) WaitForVolumeStatus(ctx context.Context, volumeId, operation string, target, transitional []string, timeout time.Duration) (Volume, error) {
+	var vol Volume
+	err := waitForStatus(ctx, "Volume", volumeId, operation, target, transitional, timeout, func() (string, error) {
+		var err error
+		if vol, err = c.GetVolume(ctx, volumeId); err != nil {
+			return "", err
+		}
+		if vol.Id == "" {
+			return STATUS_DELETED, nil
+		}
+		return vol.Status, nil
+	})
+	return vol, err
+}
+
+// Polls a single snapshot until it reaches one of the target states
+func (c CloudClient) WaitForSnapshotStatus(ctx context.Context, snapshotId, operation string, target, transitional []string, timeout time.Duration) (Snapshot, error) {
+	var snapshot Snapshot
+	err := waitForStatus(ctx, "Snapshot", snapshotId, operation, target, transitional, timeout, func() (string, error) {
+		var err error
+		if snapshot, err = c.GetSnapshot(ctx, snapshotId); err != nil {
+			return "", err
+		}
+		if snapshot.Id == "" {
+			return STATUS_DELETED, nil
+		}
+		return snapshot.Status, nil
+	})
+	return snapshot, err
+}
+
+// Waits for a new volume to become available
+func (c CloudClient) WaitForCreate(ctx context.Context, volumeId string) (Volume, error) {
+	defer c.volumes.Invalidate()
+	return c.WaitForVolumeStatus(ctx, volumeId, "create", []string{"available"}, []string{"creating"}, c.Conf.timeout(c.Conf.CreateTimeout))
+}
+
+// Waits for a volume to be attached to this server
+func (c CloudClient) WaitForAttach(ctx context.Context, volumeId string) (Volume, error) {
+	vol, err := c.WaitForVolumeStatus(ctx, volumeId, "attach", []string{"in-use"}, []string{"available", "attaching"}, c.Conf.timeout(c.Conf.AttachTimeout))
+	if err == nil && !contains(vol.AttachedTo, c.Conf.ServerId) {
+		return vol, fmt.Errorf("Volume %s is in use, but attached to %s rather than this server", volumeId, strings.Join(vol.AttachedTo, ", "))
+	}
+	return vol, err
+}
+
+// Waits for a volume to be detached from all servers
+func (c CloudClient) WaitForDetach(ctx context.Context, volumeId string) (Volume, error) {
+	return c.WaitForVolumeStatus(ctx, volumeId, "detach", []string{"available"}, []string{"in-use", "detaching"}, c.Conf.timeout(c.Conf.DetachTimeout))
+}
+
+// Waits for a volume to be deleted
+func (c CloudClient) WaitForDelete(ctx context.Context, volumeId string) error {
+	defer c.volumes.Invalidate()
+	_, err := c.WaitForVolumeStatus(ctx, volumeId, "delete", []string{STATUS_DELETED}, []string{"available", "deleting"}, c.Conf.timeout(c.Conf.DeleteTimeout))
+	return err
+}
+
+// Waits for a new snapshot to become available
+func (c CloudClient) WaitForSnapshot(ctx context.Context, snapshotId string) (Snapshot, error) {
+	return c.WaitForSnapshotStatus(ctx, snapshotId, "snapshot", []string{"available"}, []string{"creating"}, c.Conf.timeout(c.Conf.SnapshotTimeout))
+}
+
+// Waits for a snapshot to be deleted
+func (c CloudClient) WaitForSnapshotDelete(ctx context.Context, snapshotId string) error {
+	_, err := c.WaitForSnapshotStatus(ctx, snapshotId, "snapshot delete", []string{STATUS_DELETED}, []string{"available", "deleting"}, c.Conf.timeout(c.Conf.SnapshotTimeout))
+	return err
+}
+
+// Waits for a volume to reach the given size after an upsize, either attached or not
+func (c CloudClient) WaitForUpsize(ctx context.Context, volumeId string, size int) (Volume, error) {
+	var vol Volume
+	err := waitForStatus(ctx, "Volume", volumeId, "upsize", []string{"available", "in-use"}, []string{"extending", "resizing"}, c.Conf.timeout(c.Conf.ResizeTimeout), func() (string, error) {
+		var err error
+		if vol, err = c.GetVolume(ctx, volumeId); err != nil {
+			return "", err
+		}
+		if vol.Id == "" {
+			return STATUS_DELETED, nil
+		}
+		// the status may not have changed yet right after the request
+		if vol.Size < size && (vol.Status == "available" || vol.Status == "in-use") {
+			return "extending", nil
+		}
+		return vol.Status, nil
+	})
+	return vol, err
+}